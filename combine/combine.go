@@ -0,0 +1,360 @@
+// Package combine parses Go stack traces and groups goroutines that share
+// the same stack into buckets. It is used by the combinestacks HTTP
+// handlers, but is factored out so other tools (CI log post-processors,
+// dashboards) can consume combined stacks programmatically instead of
+// scraping the text output.
+package combine
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Frame is a single call in a goroutine's stack.
+type Frame struct {
+	Function string `json:"function"`
+	Args     string `json:"args"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// Routine is a single parsed goroutine.
+type Routine struct {
+	Label   string  `json:"label"`
+	State   string  `json:"state"`
+	Stack   []Frame `json:"stack"`
+	Created Frame   `json:"created_by"`
+}
+
+var startRuntimeStack = regexp.MustCompile(`(runtime stack):`)
+
+const runtimeState = "running"
+
+// example: goroutine 12345 [running]:
+var goroutineStart = regexp.MustCompile(`goroutine (\d+) \[([^\]]+)\]`)
+
+var callLine = regexp.MustCompile(`([^ ]+)\(([^)]*)\)\s*$`)
+
+var createdByLine = regexp.MustCompile(`created by ([^ ]+)`)
+
+// .go stacks end with +0x66
+// .s stacks end with fp=0xcb8de6e140 sp=0xcb8de6e138 pc=0x475e60
+// we just ignore anything after the file/line number
+var fileLine = regexp.MustCompile(`([^\s]+):(\d+)($| \+| fp=).*$`)
+
+// Parse reads Go stack trace text from r and returns the parsed goroutines,
+// in the order they were printed.
+func Parse(r io.Reader) ([]Routine, error) {
+	parsedRoutines := []Routine{}
+	scanner := bufio.NewScanner(r)
+
+	createdByFound := false
+	for scanner.Scan() {
+		matches := startRuntimeStack.FindSubmatch(scanner.Bytes())
+		if len(matches) > 0 {
+			r := Routine{string(matches[1]), runtimeState, nil, Frame{}}
+			parsedRoutines = append(parsedRoutines, r)
+			createdByFound = false
+			continue
+		}
+
+		matches = goroutineStart.FindSubmatch(scanner.Bytes())
+		if len(matches) > 0 {
+			r := Routine{string(matches[1]), string(matches[2]), nil, Frame{}}
+			parsedRoutines = append(parsedRoutines, r)
+			createdByFound = false
+			continue
+		}
+
+		matches = callLine.FindSubmatch(scanner.Bytes())
+		if len(matches) > 0 {
+			if len(parsedRoutines) == 0 {
+				return nil, errors.New("found call line without a routine: " + scanner.Text())
+			}
+
+			f := Frame{string(matches[1]), string(matches[2]), "", 0}
+			parsedRoutines[len(parsedRoutines)-1].Stack = append(parsedRoutines[len(parsedRoutines)-1].Stack, f)
+			continue
+		}
+
+		matches = createdByLine.FindSubmatch(scanner.Bytes())
+		if len(matches) > 0 {
+			if len(parsedRoutines) == 0 {
+				return nil, errors.New("found created by line without a routine: " + scanner.Text())
+			}
+
+			f := Frame{string(matches[1]), "", "", 0}
+			parsedRoutines[len(parsedRoutines)-1].Created = f
+			createdByFound = true
+			continue
+		}
+
+		matches = fileLine.FindSubmatch(scanner.Bytes())
+		if len(matches) > 0 {
+			line, err := strconv.ParseInt(string(matches[2]), 10, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(parsedRoutines) == 0 {
+				return nil, errors.New("found file line without a routine: " + scanner.Text())
+			}
+			lastRoutine := parsedRoutines[len(parsedRoutines)-1]
+
+			if createdByFound {
+				lastRoutine.Created.File = string(matches[1])
+				lastRoutine.Created.Line = int(line)
+				createdByFound = false
+			} else {
+				if len(lastRoutine.Stack) == 0 {
+					return nil, errors.New("found file line without a frame: " + scanner.Text())
+				}
+
+				lastRoutine.Stack[len(lastRoutine.Stack)-1].File = string(matches[1])
+				lastRoutine.Stack[len(lastRoutine.Stack)-1].Line = int(line)
+			}
+			parsedRoutines[len(parsedRoutines)-1] = lastRoutine
+			continue
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+	return parsedRoutines, nil
+}
+
+// StackHash identifies a unique stack (frames plus the created-by frame).
+type StackHash [sha256.Size]byte
+
+func (s StackHash) String() string {
+	return hex.EncodeToString(s[0:len(s)])
+}
+
+func hashFrame(w io.Writer, f Frame) {
+	w.Write([]byte(f.Function))
+	w.Write([]byte("|"))
+	w.Write([]byte(f.File))
+	w.Write([]byte("|"))
+	w.Write([]byte(strconv.Itoa(f.Line)))
+	w.Write([]byte("|"))
+}
+
+// Hash returns a hash that is identical for routines sharing the same stack.
+// If includeState is true, the state (e.g. "running", "semacquire") is
+// mixed into the hash too, so otherwise-identical stacks in different states
+// land in different buckets; see GroupOptions.SplitByState.
+func Hash(r Routine, includeState bool) StackHash {
+	hasher := sha256.New()
+	if includeState {
+		hasher.Write([]byte(r.State))
+		hasher.Write([]byte("|"))
+	}
+	for _, frame := range r.Stack {
+		hashFrame(hasher, frame)
+	}
+	hashFrame(hasher, r.Created)
+
+	// copy the hash to the output array
+	var output StackHash
+	slice := output[0:0:len(output)]
+	hasher.Sum(slice)
+	return output
+}
+
+// StateCount is the number of goroutines observed in a given state, within
+// either a single bucket or across a whole snapshot; see Bucket.States and
+// StateSummary.
+type StateCount struct {
+	State string `json:"state"`
+	Count int    `json:"count"`
+}
+
+// stateCounts tallies routines by State, sorted by count descending (ties
+// broken by state name) so the dominant state leads the histogram, e.g.
+// state=[semacquire:42, chan receive:3].
+func stateCounts(routines []Routine) []StateCount {
+	counts := map[string]int{}
+	for _, r := range routines {
+		counts[r.State]++
+	}
+	result := make([]StateCount, 0, len(counts))
+	for state, count := range counts {
+		result = append(result, StateCount{State: state, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].State < result[j].State
+	})
+	return result
+}
+
+// StateSummary tallies routines by state across an entire snapshot,
+// regardless of how they are bucketed, for a top-level "how many are stuck
+// waiting vs running" overview.
+func StateSummary(routines []Routine) []StateCount {
+	return stateCounts(routines)
+}
+
+// Bucket groups routines that share the same stack.
+type Bucket struct {
+	StackHash          string       `json:"stack_hash"`
+	Count              int          `json:"count"`
+	ExampleGoroutineID string       `json:"example_goroutine_id"`
+	States             []StateCount `json:"states"`
+	Stack              []Frame      `json:"stack"`
+	CreatedBy          Frame        `json:"created_by"`
+}
+
+// GroupOptions controls how Group buckets routines.
+type GroupOptions struct {
+	// SplitByState, when true, buckets routines separately per state in
+	// addition to by stack, so e.g. a "running" goroutine and a
+	// "semacquire" goroutine with identical stacks land in different
+	// buckets. When false (the default), they land in the same bucket,
+	// and Bucket.States reports the per-state breakdown.
+	SplitByState bool
+}
+
+// Group buckets routines by their StackHash, sorted from the largest bucket
+// to the smallest.
+func Group(routines []Routine, opts GroupOptions) []Bucket {
+	groups := map[StackHash][]Routine{}
+	for _, r := range routines {
+		h := Hash(r, opts.SplitByState)
+		groups[h] = append(groups[h], r)
+	}
+
+	sortedGroupHashes := make([]StackHash, 0, len(groups))
+	for h := range groups {
+		sortedGroupHashes = append(sortedGroupHashes, h)
+	}
+	sort.Slice(sortedGroupHashes, func(i int, j int) bool {
+		iGroups := groups[sortedGroupHashes[i]]
+		jGroups := groups[sortedGroupHashes[j]]
+		return len(iGroups) > len(jGroups)
+	})
+
+	buckets := make([]Bucket, 0, len(sortedGroupHashes))
+	for _, h := range sortedGroupHashes {
+		group := groups[h]
+		buckets = append(buckets, Bucket{
+			StackHash:          h.String(),
+			Count:              len(group),
+			ExampleGoroutineID: group[0].Label,
+			States:             stateCounts(group),
+			Stack:              group[0].Stack,
+			CreatedBy:          group[0].Created,
+		})
+	}
+	return buckets
+}
+
+// FilterStates returns the subset of routines whose State passes include and
+// exclude. If include is non-empty, only routines whose state is in include
+// are kept; exclude is then applied on top, dropping any routine whose
+// state is in it. Either list may be empty to skip that half of the filter.
+func FilterStates(routines []Routine, include, exclude []string) []Routine {
+	if len(include) == 0 && len(exclude) == 0 {
+		return routines
+	}
+	includeSet := make(map[string]bool, len(include))
+	for _, s := range include {
+		includeSet[s] = true
+	}
+	excludeSet := make(map[string]bool, len(exclude))
+	for _, s := range exclude {
+		excludeSet[s] = true
+	}
+
+	filtered := make([]Routine, 0, len(routines))
+	for _, r := range routines {
+		if len(includeSet) > 0 && !includeSet[r.State] {
+			continue
+		}
+		if excludeSet[r.State] {
+			continue
+		}
+		filtered = append(filtered, r)
+	}
+	return filtered
+}
+
+// DiffEntry is one stack's goroutine counts in a before/after comparison.
+type DiffEntry struct {
+	StackHash    string  `json:"stack_hash"`
+	Stack        []Frame `json:"stack"`
+	CreatedBy    Frame   `json:"created_by"`
+	ExampleState string  `json:"example_state"`
+	BeforeCount  int     `json:"before_count"`
+	AfterCount   int     `json:"after_count"`
+	Delta        int     `json:"delta"`
+}
+
+// exampleState returns the most common state in a bucket, for display
+// alongside a diff entry; states[0] since Bucket.States is sorted by count
+// descending.
+func exampleState(states []StateCount) string {
+	if len(states) == 0 {
+		return ""
+	}
+	return states[0].State
+}
+
+// Diff joins two bucketed snapshots of the same process on StackHash,
+// typically captured a few seconds apart, to see which stacks are growing.
+// A bucket present in only one snapshot gets a 0 count on the other side.
+// The result is sorted by the absolute value of Delta, largest first, since
+// that is what matters when hunting for a leak.
+func Diff(before, after []Bucket) []DiffEntry {
+	entries := map[string]*DiffEntry{}
+	for _, b := range before {
+		entries[b.StackHash] = &DiffEntry{
+			StackHash:    b.StackHash,
+			Stack:        b.Stack,
+			CreatedBy:    b.CreatedBy,
+			ExampleState: exampleState(b.States),
+			BeforeCount:  b.Count,
+		}
+	}
+	for _, b := range after {
+		e, ok := entries[b.StackHash]
+		if !ok {
+			e = &DiffEntry{
+				StackHash:    b.StackHash,
+				Stack:        b.Stack,
+				CreatedBy:    b.CreatedBy,
+				ExampleState: exampleState(b.States),
+			}
+			entries[b.StackHash] = e
+		}
+		e.AfterCount = b.Count
+	}
+
+	result := make([]DiffEntry, 0, len(entries))
+	for _, e := range entries {
+		e.Delta = e.AfterCount - e.BeforeCount
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		di, dj := result[i].Delta, result[j].Delta
+		if di < 0 {
+			di = -di
+		}
+		if dj < 0 {
+			dj = -dj
+		}
+		if di != dj {
+			return di > dj
+		}
+		return result[i].StackHash < result[j].StackHash
+	})
+	return result
+}
@@ -1,255 +1,378 @@
 package main
 
 import (
-	"bufio"
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
-	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/evanj/combinestacks/combine"
 	"github.com/evanj/combinestacks/forked/panicparse/exportpanicparse"
 )
 
 const portEnvVar = "PORT"
 const uploadPath = "/upload"
 const panicParsePath = "/panicparse"
+const apiAggregatePath = "/api/aggregate"
+const diffPath = "/diff"
 const textFormID = "text"
 const fileFormID = "file"
-const maxFormMemoryBytes = 32 * 1024 * 1024
 
-type frame struct {
-	function string
-	args     string
-	file     string
-	line     int
+// form fields for the before/after snapshots accepted by handleDiff, plus
+// the delta threshold used to filter out noisy, barely-changed buckets.
+const beforeTextFormID = "before"
+const beforeFileFormID = "beforeFile"
+const afterTextFormID = "after"
+const afterFileFormID = "afterFile"
+const thresholdFormID = "threshold"
+
+// streamFormID is the query parameter (not form field: see
+// streamedMultipartReader) that opts a multipart upload into streaming mode.
+const streamFormID = "stream"
+
+// maxUploadBytesFlag and maxUploadBytesEnvVar configure maxUploadBytes.
+const maxUploadBytesFlag = "max-upload-bytes"
+const maxUploadBytesEnvVar = "MAX_UPLOAD_BYTES"
+const defaultMaxUploadBytes = 32 * 1024 * 1024
+
+// maxUploadBytes bounds the size of a stack dump accepted by the upload
+// handlers below, whether buffered or streamed. It is set once in main from
+// the -max-upload-bytes flag or MAX_UPLOAD_BYTES env var.
+var maxUploadBytes int64 = defaultMaxUploadBytes
+
+// form fields controlling panicparse's stack.Opts-equivalent behavior
+const nameArgumentsFormID = "nameArguments"
+const analyzeSourcesFormID = "analyzeSources"
+const guessPathsFormID = "guessPaths"
+const needsEnvFormID = "needsEnv"
+const localGOROOTFormID = "localGOROOT"
+const localGOPATHsFormID = "localGOPATHs"
+
+// query parameters controlling state-based grouping/filtering for
+// handleUpload and handleAPIAggregate. These are query parameters rather
+// than form fields so they work alongside the streaming upload paths too,
+// which never parse a form at all; see getStackReader.
+const includeStatesQueryParam = "include"
+const excludeStatesQueryParam = "exclude"
+const splitByStateQueryParam = "splitByState"
+
+// stateFilterFromQuery reads the include/exclude state lists and the
+// splitByState toggle from r's query string.
+func stateFilterFromQuery(r *http.Request) (include, exclude []string, splitByState bool) {
+	q := r.URL.Query()
+	if v := q.Get(includeStatesQueryParam); v != "" {
+		include = strings.Split(v, ",")
+	}
+	if v := q.Get(excludeStatesQueryParam); v != "" {
+		exclude = strings.Split(v, ",")
+	}
+	splitByState = q.Get(splitByStateQueryParam) != ""
+	return include, exclude, splitByState
 }
 
-type routine struct {
-	label   string
-	state   string
-	stack   []frame
-	created frame
+// aggregateResult is the JSON shape returned by writeAggregatedJSON: the
+// per-stack buckets plus a top-level summary of how many goroutines are in
+// each state across the whole snapshot.
+type aggregateResult struct {
+	Buckets      []combine.Bucket     `json:"buckets"`
+	StateSummary []combine.StateCount `json:"state_summary"`
 }
 
-var startRuntimeStack = regexp.MustCompile(`(runtime stack):`)
-
-const runtimeState = "running"
-
-// example: goroutine 12345 [running]:
-var goroutineStart = regexp.MustCompile(`goroutine (\d+) \[([^\]]+)\]`)
-
-var callLine = regexp.MustCompile(`([^ ]+)\(([^)]*)\)\s*$`)
-
-var createdByLine = regexp.MustCompile(`created by ([^ ]+)`)
-
-// .go stacks end with +0x66
-// .s stacks end with fp=0xcb8de6e140 sp=0xcb8de6e138 pc=0x475e60
-// we just ignore anything after the file/line number
-var fileLine = regexp.MustCompile(`([^\s]+):(\d+)($| \+| fp=).*$`)
+// formatStateCounts renders a state histogram like "semacquire:42, chan
+// receive:3" for display in the text output.
+func formatStateCounts(states []combine.StateCount) string {
+	parts := make([]string, len(states))
+	for i, s := range states {
+		parts[i] = fmt.Sprintf("%s:%d", s.State, s.Count)
+	}
+	return strings.Join(parts, ", ")
+}
 
-func parse(r io.Reader) ([]routine, error) {
-	parsedRoutines := []routine{}
-	scanner := bufio.NewScanner(r)
+// writeAggregated writes aggregated stacks to w as text.
+func writeAggregated(w io.Writer, routines []combine.Routine, opts combine.GroupOptions) error {
+	buckets := combine.Group(routines, opts)
 
-	createdByFound := false
-	for scanner.Scan() {
-		matches := startRuntimeStack.FindSubmatch(scanner.Bytes())
-		if len(matches) > 0 {
-			r := routine{string(matches[1]), runtimeState, nil, frame{}}
-			parsedRoutines = append(parsedRoutines, r)
-			createdByFound = false
-			continue
-		}
+	fmt.Fprintf(w, "Found %d total goroutines\n", len(routines))
+	fmt.Fprintf(w, "By state: %s\n", formatStateCounts(combine.StateSummary(routines)))
+	for _, b := range buckets {
+		fmt.Fprintf(w, "\n%d goroutines; example goroutine=%s; state=[%s]\n",
+			b.Count, b.ExampleGoroutineID, formatStateCounts(b.States))
 
-		matches = goroutineStart.FindSubmatch(scanner.Bytes())
-		if len(matches) > 0 {
-			r := routine{string(matches[1]), string(matches[2]), nil, frame{}}
-			parsedRoutines = append(parsedRoutines, r)
-			createdByFound = false
-			continue
+		for _, f := range b.Stack {
+			fmt.Fprintf(w, "%s(%s)\n", f.Function, f.Args)
+			fmt.Fprintf(w, "\t%s:%d\n", f.File, f.Line)
 		}
-
-		matches = callLine.FindSubmatch(scanner.Bytes())
-		if len(matches) > 0 {
-			if len(parsedRoutines) == 0 {
-				return nil, errors.New("found call line without a routine: " + scanner.Text())
-			}
-
-			f := frame{string(matches[1]), string(matches[2]), "", 0}
-			parsedRoutines[len(parsedRoutines)-1].stack = append(parsedRoutines[len(parsedRoutines)-1].stack, f)
-			continue
+		if b.CreatedBy.Function != "" {
+			fmt.Fprintf(w, "created by %s\n", b.CreatedBy.Function)
+			fmt.Fprintf(w, "\t%s:%d\n", b.CreatedBy.File, b.CreatedBy.Line)
 		}
+	}
+	return nil
+}
 
-		matches = createdByLine.FindSubmatch(scanner.Bytes())
-		if len(matches) > 0 {
-			if len(parsedRoutines) == 0 {
-				return nil, errors.New("found created by line without a routine: " + scanner.Text())
-			}
+// writeAggregatedJSON writes aggregated stacks and their state summary to w
+// as JSON.
+func writeAggregatedJSON(w io.Writer, routines []combine.Routine, opts combine.GroupOptions) error {
+	return json.NewEncoder(w).Encode(aggregateResult{
+		Buckets:      combine.Group(routines, opts),
+		StateSummary: combine.StateSummary(routines),
+	})
+}
 
-			f := frame{string(matches[1]), "", "", 0}
-			parsedRoutines[len(parsedRoutines)-1].created = f
-			createdByFound = true
-			continue
+// filterDiffThreshold drops entries whose |delta| is below threshold, to cut
+// noise from transient goroutines when comparing two large dumps. threshold
+// <= 0 disables filtering.
+func filterDiffThreshold(entries []combine.DiffEntry, threshold int) []combine.DiffEntry {
+	if threshold <= 0 {
+		return entries
+	}
+	filtered := entries[:0]
+	for _, e := range entries {
+		d := e.Delta
+		if d < 0 {
+			d = -d
 		}
-
-		matches = fileLine.FindSubmatch(scanner.Bytes())
-		if len(matches) > 0 {
-			line, err := strconv.ParseInt(string(matches[2]), 10, 0)
-			if err != nil {
-				return nil, err
-			}
-
-			if len(parsedRoutines) == 0 {
-				return nil, errors.New("found file line without a routine: " + scanner.Text())
-			}
-			lastRoutine := parsedRoutines[len(parsedRoutines)-1]
-
-			if createdByFound {
-				lastRoutine.created.file = string(matches[1])
-				lastRoutine.created.line = int(line)
-				createdByFound = false
-			} else {
-				if len(lastRoutine.stack) == 0 {
-					return nil, errors.New("found file line without a frame: " + scanner.Text())
-				}
-
-				lastRoutine.stack[len(lastRoutine.stack)-1].file = string(matches[1])
-				lastRoutine.stack[len(lastRoutine.stack)-1].line = int(line)
-			}
-			parsedRoutines[len(parsedRoutines)-1] = lastRoutine
-			continue
+		if d >= threshold {
+			filtered = append(filtered, e)
 		}
 	}
-	if scanner.Err() != nil {
-		return nil, scanner.Err()
-	}
-	return parsedRoutines, nil
+	return filtered
 }
 
-func print(routines []routine) {
-	for i, routine := range routines {
-		fmt.Printf("%d %s [%s]\n", i, routine.label, routine.state)
-		for j, f := range routine.stack {
-			fmt.Printf("  %2d: %s(%s)\n", j, f.function, f.args)
-			fmt.Printf("        %s:%d\n", f.file, f.line)
+// writeDiffText writes a before/after diff to w as text.
+func writeDiffText(w io.Writer, entries []combine.DiffEntry) error {
+	fmt.Fprintf(w, "Found %d distinct stacks\n", len(entries))
+	for _, e := range entries {
+		fmt.Fprintf(w, "\n%+d (before=%d after=%d); example state=[%s]\n",
+			e.Delta, e.BeforeCount, e.AfterCount, e.ExampleState)
+
+		for _, f := range e.Stack {
+			fmt.Fprintf(w, "%s(%s)\n", f.Function, f.Args)
+			fmt.Fprintf(w, "\t%s:%d\n", f.File, f.Line)
 		}
-		if routine.created.function != "" {
-			fmt.Printf("  created by %s\n", routine.created.function)
-			fmt.Printf("        %s:%d\n", routine.created.file, routine.created.line)
+		if e.CreatedBy.Function != "" {
+			fmt.Fprintf(w, "created by %s\n", e.CreatedBy.Function)
+			fmt.Fprintf(w, "\t%s:%d\n", e.CreatedBy.File, e.CreatedBy.Line)
 		}
 	}
+	return nil
 }
 
-type stackHash [sha256.Size]byte
-
-func (s stackHash) String() string {
-	return hex.EncodeToString(s[0:len(s)])
+// writeDiffJSON writes a before/after diff to w as JSON.
+func writeDiffJSON(w io.Writer, entries []combine.DiffEntry) error {
+	return json.NewEncoder(w).Encode(entries)
 }
 
-func hashFrame(w io.Writer, f frame) {
-	w.Write([]byte(f.function))
-	w.Write([]byte("|"))
-	w.Write([]byte(f.file))
-	w.Write([]byte("|"))
-	w.Write([]byte(strconv.Itoa(f.line)))
-	w.Write([]byte("|"))
+// writeDiffHTML writes a before/after diff to w as an HTML table, colorizing
+// growing stacks red and shrinking stacks green. It uses html/template
+// rather than the string-concatenation rootTemplate uses, since stack frames
+// come from the uploaded dump and must be escaped.
+func writeDiffHTML(w io.Writer, entries []combine.DiffEntry) error {
+	return diffTemplate.Execute(w, entries)
 }
 
-func hash(r routine) stackHash {
-	hasher := sha256.New()
-	for _, frame := range r.stack {
-		hashFrame(hasher, frame)
-	}
-	hashFrame(hasher, r.created)
+var diffTemplate = template.Must(template.New("diff").Parse(`<!doctype html>
+<html>
+<head><title>Stack Diff</title></head>
+<body>
+<h1>Stack Diff</h1>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>delta</th><th>before</th><th>after</th><th>state</th><th>stack</th></tr>
+{{range .}}
+<tr{{if gt .Delta 0}} style="color: red"{{else if lt .Delta 0}} style="color: green"{{end}}>
+<td>{{printf "%+d" .Delta}}</td>
+<td>{{.BeforeCount}}</td>
+<td>{{.AfterCount}}</td>
+<td>{{.ExampleState}}</td>
+<td><pre>{{range .Stack}}{{.Function}}({{.Args}})
+	{{.File}}:{{.Line}}
+{{end}}{{if .CreatedBy.Function}}created by {{.CreatedBy.Function}}
+	{{.CreatedBy.File}}:{{.CreatedBy.Line}}
+{{end}}</pre></td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
 
-	// copy the hash to the output array
-	var output stackHash
-	slice := output[0:0:len(output)]
-	hasher.Sum(slice)
-	return output
+var errMissing = errors.New("combinestacks: missing stack text")
+
+// errTooLarge is returned by a limitReader, and therefore surfaces from
+// combine.Parse/exportpanicparse.ProcessHTML, once a stream exceeds
+// maxUploadBytes.
+var errTooLarge = errors.New("combinestacks: upload exceeds the maximum allowed size")
+
+// limitReader wraps r, failing reads with errTooLarge instead of silently
+// truncating once more than limit bytes have been read. It reads one byte
+// past limit so it can tell an upload of exactly limit bytes (fine) apart
+// from one that merely starts with limit bytes (too large); the logic
+// mirrors the stdlib's http.MaxBytesReader.
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	err error
 }
 
-// writeAggregated writes aggregated stacks to w.
-func writeAggregated(w io.Writer, routines []routine) error {
-	groups := map[stackHash][]routine{}
-	for _, r := range routines {
-		h := hash(r)
-		groups[h] = append(groups[h], r)
-	}
+func newLimitReader(r io.Reader, limit int64) *limitReader {
+	return &limitReader{r: r, n: limit}
+}
 
-	// sort the group keys in descending order (largest groups to smallest)
-	sortedGroupHashes := make([]stackHash, 0, len(groups))
-	for h := range groups {
-		sortedGroupHashes = append(sortedGroupHashes, h)
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
 	}
-	sort.Slice(sortedGroupHashes, func(i int, j int) bool {
-		iGroups := groups[sortedGroupHashes[i]]
-		jGroups := groups[sortedGroupHashes[j]]
-		return len(iGroups) > len(jGroups)
-	})
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) <= l.n {
+		l.n -= int64(n)
+		l.err = err
+		return n, err
+	}
+	n = int(l.n)
+	l.n = 0
+	l.err = errTooLarge
+	return n, l.err
+}
 
-	fmt.Fprintf(w, "Found %d total goroutines\n", len(routines))
-	for _, h := range sortedGroupHashes {
-		group := groups[h]
-		fmt.Fprintf(w, "\n%d goroutines; example goroutine=%s; state=[%s]\n",
-			len(group), group[0].label, group[0].state)
+// isPlainTextUpload returns true if r's body is a raw stack dump rather than
+// a multipart form, i.e. it was posted with "Content-Type: text/plain".
+func isPlainTextUpload(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/plain"
+}
 
-		for _, f := range group[0].stack {
-			fmt.Fprintf(w, "%s(%s)\n", f.function, f.args)
-			fmt.Fprintf(w, "\t%s:%d\n", f.file, f.line)
+// streamedMultipartReader reads the text or file part of a multipart upload
+// directly off the wire via r.MultipartReader, instead of buffering the
+// whole form into memory the way r.ParseMultipartForm does. It only returns
+// the first text/file part found; any panicparse option fields sent
+// alongside it are not consumed, so panicParseOptsFromForm will see them as
+// unset (see its doc comment).
+func streamedMultipartReader(r *http.Request) (io.Reader, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errMissing
+		}
+		if err != nil {
+			return nil, err
 		}
-		if group[0].created.function != "" {
-			fmt.Fprintf(w, "created by %s\n", group[0].created.function)
-			fmt.Fprintf(w, "\t%s:%d\n", group[0].created.file, group[0].created.line)
+		switch part.FormName() {
+		case textFormID, fileFormID:
+			return newLimitReader(part, maxUploadBytes), nil
 		}
 	}
-	return nil
 }
 
-var errMissing = errors.New("combinestacks: missing stack text")
+// getStackReader extracts a reader over the uploaded stack dump text,
+// enforcing maxUploadBytes. Real goroutine dumps from services with tens of
+// thousands of goroutines can be large, so two cases avoid ever buffering
+// the whole upload in memory: a text/plain body is read straight from
+// r.Body, and a multipart upload with "?stream=1" is read one part at a time
+// via streamedMultipartReader. Anything else falls back to the original
+// r.ParseMultipartForm-based path below, which buffers the selected field
+// but also parses the full form up front, which panicParseOptsFromForm
+// depends on.
+func getStackReader(r *http.Request) (io.Reader, error) {
+	if isPlainTextUpload(r) {
+		return newLimitReader(r.Body, maxUploadBytes), nil
+	}
+	if r.URL.Query().Get(streamFormID) != "" {
+		return streamedMultipartReader(r)
+	}
 
-func getStackText(r *http.Request) (string, error) {
-	err := r.ParseMultipartForm(maxFormMemoryBytes)
+	err := r.ParseMultipartForm(maxUploadBytes)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// try the form field first then fall back to file upload
 	v := r.FormValue(textFormID)
 	if v != "" {
-		return v, nil
+		return newLimitReader(strings.NewReader(v), maxUploadBytes), nil
 	}
 
 	mpf, _, err := r.FormFile(fileFormID)
 	if err == http.ErrMissingFile {
-		return "", errMissing
+		return nil, errMissing
 	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	fBytes, err := ioutil.ReadAll(mpf)
+	fBytes, err := ioutil.ReadAll(newLimitReader(mpf, maxUploadBytes))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	err = mpf.Close()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	v = string(fBytes)
-	if v == "" {
-		return "", errMissing
+	if len(fBytes) == 0 {
+		return nil, errMissing
+	}
+	return strings.NewReader(string(fBytes)), nil
+}
+
+// respondStackReaderError writes the response for an error returned by
+// getStackReader, panicking for anything it doesn't recognize.
+func respondStackReaderError(w http.ResponseWriter, err error) {
+	switch err {
+	case errMissing:
+		http.Error(w, "must provide content", http.StatusBadRequest)
+	case errTooLarge:
+		respondTooLarge(w)
+	default:
+		panic(err)
+	}
+}
+
+// respondParseError writes the response for an error returned by
+// combine.Parse or exportpanicparse.ProcessHTML: errTooLarge can reach here
+// too, since it is discovered lazily as the parser reads through the
+// streamed reader rather than up front in getStackReader.
+func respondParseError(w http.ResponseWriter, err error) {
+	if err == errTooLarge {
+		respondTooLarge(w)
+		return
 	}
-	return v, nil
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// tooLargeResponse is the structured body returned alongside a 413 so
+// programmatic clients can tell a too-large upload apart from a malformed
+// one without parsing error text.
+type tooLargeResponse struct {
+	Error          string `json:"error"`
+	MaxUploadBytes int64  `json:"max_upload_bytes"`
+}
+
+func respondTooLarge(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	// Best-effort: the client already knows the upload was rejected from the
+	// status code alone, so a write failure here isn't actionable.
+	_ = json.NewEncoder(w).Encode(tooLargeResponse{
+		Error:          errTooLarge.Error(),
+		MaxUploadBytes: maxUploadBytes,
+	})
 }
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
@@ -258,24 +381,67 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
 		return
 	}
-	v, err := getStackText(r)
+	stackReader, err := getStackReader(r)
+	if err != nil {
+		respondStackReaderError(w, err)
+		return
+	}
+
+	routines, err := combine.Parse(stackReader)
+	if err != nil {
+		respondParseError(w, err)
+		return
+	}
+
+	include, exclude, splitByState := stateFilterFromQuery(r)
+	routines = combine.FilterStates(routines, include, exclude)
+	opts := combine.GroupOptions{SplitByState: splitByState}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		err = writeAggregatedJSON(w, routines, opts)
+	} else {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		err = writeAggregated(w, routines, opts)
+	}
 	if err != nil {
-		if err == errMissing {
-			http.Error(w, "must provide content", http.StatusBadRequest)
-			return
-		}
 		panic(err)
 	}
+}
 
-	routines, err := parse(strings.NewReader(v))
+// wantsJSON returns true if the request's Accept header prefers JSON over
+// other content types.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// handleAPIAggregate is the machine-readable equivalent of handleUpload: it
+// always returns the aggregated goroutine buckets as JSON, regardless of the
+// Accept header.
+func handleAPIAggregate(w http.ResponseWriter, r *http.Request) {
+	log.Printf("handleAPIAggregate %s %s", r.Method, r.URL.String())
+	if r.Method != http.MethodPost {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+	stackReader, err := getStackReader(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		respondStackReaderError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
-	err = writeAggregated(w, routines)
+	routines, err := combine.Parse(stackReader)
 	if err != nil {
+		respondParseError(w, err)
+		return
+	}
+
+	include, exclude, splitByState := stateFilterFromQuery(r)
+	routines = combine.FilterStates(routines, include, exclude)
+	opts := combine.GroupOptions{SplitByState: splitByState}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if err := writeAggregatedJSON(w, routines, opts); err != nil {
 		panic(err)
 	}
 }
@@ -286,21 +452,156 @@ func handlePanicParse(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
 		return
 	}
-	v, err := getStackText(r)
+	stackReader, err := getStackReader(r)
+	if err != nil {
+		respondStackReaderError(w, err)
+		return
+	}
+
+	// Must be read after getStackReader: for the buffered (non-streaming)
+	// path it populates r.Form as a side effect; for the streaming paths
+	// these fields are simply unset, since there is no form left to read.
+	opts := panicParseOptsFromForm(r)
+
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	err = exportpanicparse.ProcessHTML(stackReader, w, opts)
 	if err != nil {
-		if err == errMissing {
-			http.Error(w, "must provide content", http.StatusBadRequest)
-			return
+		respondParseError(w, err)
+		return
+	}
+}
+
+// panicParseOptsFromForm reads the panicparse option checkboxes/fields from
+// an already-parsed multipart form. r.ParseMultipartForm must have already
+// been called, e.g. via getStackReader; for requests handled by its
+// streaming paths there is no parsed form, so every option reads as unset.
+func panicParseOptsFromForm(r *http.Request) exportpanicparse.Options {
+	var localGOPATHs []string
+	if v := r.FormValue(localGOPATHsFormID); v != "" {
+		localGOPATHs = strings.Split(v, ",")
+	}
+	return exportpanicparse.Options{
+		GuessPaths:     r.FormValue(guessPathsFormID) != "",
+		NeedsEnv:       r.FormValue(needsEnvFormID) != "",
+		NameArguments:  r.FormValue(nameArgumentsFormID) != "",
+		AnalyzeSources: r.FormValue(analyzeSourcesFormID) != "",
+		LocalGOROOT:    r.FormValue(localGOROOTFormID),
+		LocalGOPATHs:   localGOPATHs,
+	}
+}
+
+// parseDiffForm parses handleDiff's form fields, accepting either a
+// multipart upload (for the beforeFile/afterFile file inputs) or a plain
+// application/x-www-form-urlencoded body (for API clients posting the
+// before/after text fields directly).
+func parseDiffForm(r *http.Request) error {
+	err := r.ParseMultipartForm(maxUploadBytes)
+	if err == http.ErrNotMultipart {
+		return r.ParseForm()
+	}
+	return err
+}
+
+// getDiffText extracts one snapshot's stack dump text from an
+// r.ParseMultipartForm'd request, given its text/file field pair. It mirrors
+// getStackReader's buffered path; diff snapshots are compared against each
+// other bucket-by-bucket afterwards anyway, so streaming them in wouldn't
+// save any memory the way it does for the single-snapshot handlers.
+func getDiffText(r *http.Request, textID, fileID string) (string, error) {
+	v := r.FormValue(textID)
+	if v != "" {
+		if int64(len(v)) > maxUploadBytes {
+			return "", errTooLarge
 		}
+		return v, nil
+	}
+
+	mpf, _, err := r.FormFile(fileID)
+	if err == http.ErrMissingFile {
+		return "", errMissing
+	}
+	if err != nil {
+		return "", err
+	}
+	fBytes, err := ioutil.ReadAll(newLimitReader(mpf, maxUploadBytes))
+	if err != nil {
+		return "", err
+	}
+	err = mpf.Close()
+	if err != nil {
+		return "", err
+	}
+	if len(fBytes) == 0 {
+		return "", errMissing
+	}
+	return string(fBytes), nil
+}
+
+// diffThresholdFromForm reads the minimum |delta| a bucket must have to
+// appear in the diff output, defaulting to 0 (no filtering) when unset or
+// invalid.
+func diffThresholdFromForm(r *http.Request) int {
+	threshold, _ := strconv.Atoi(r.FormValue(thresholdFormID))
+	return threshold
+}
+
+// handleDiff compares two stack dump snapshots ("before" and "after")
+// bucket-by-bucket and reports which stacks grew or shrank, sorted by the
+// size of the change. This is the usual workflow for investigating a leak:
+// capture SIGQUIT dumps a few seconds apart and see which stacks are
+// growing.
+func handleDiff(w http.ResponseWriter, r *http.Request) {
+	log.Printf("handleDiff %s %s", r.Method, r.URL.String())
+	if r.Method != http.MethodPost {
+		http.Error(w, "wrong method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := parseDiffForm(r); err != nil {
 		panic(err)
 	}
 
-	w.Header().Set("Content-Type", "text/html;charset=utf-8")
-	err = exportpanicparse.ProcessHTML(strings.NewReader(v), w)
+	beforeText, err := getDiffText(r, beforeTextFormID, beforeFileFormID)
+	if err != nil {
+		respondStackReaderError(w, err)
+		return
+	}
+	afterText, err := getDiffText(r, afterTextFormID, afterFileFormID)
+	if err != nil {
+		respondStackReaderError(w, err)
+		return
+	}
+
+	beforeRoutines, err := combine.Parse(strings.NewReader(beforeText))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		respondParseError(w, err)
 		return
 	}
+	afterRoutines, err := combine.Parse(strings.NewReader(afterText))
+	if err != nil {
+		respondParseError(w, err)
+		return
+	}
+
+	entries := combine.Diff(
+		combine.Group(beforeRoutines, combine.GroupOptions{}),
+		combine.Group(afterRoutines, combine.GroupOptions{}))
+	entries = filterDiffThreshold(entries, diffThresholdFromForm(r))
+
+	switch {
+	case wantsJSON(r):
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		err = writeDiffJSON(w, entries)
+	case strings.Contains(r.Header.Get("Accept"), "text/html"):
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		err = writeDiffHTML(w, entries)
+	default:
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		err = writeDiffText(w, entries)
+	}
+	if err != nil {
+		panic(err)
+	}
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -330,9 +631,28 @@ const rootTemplate = `<!doctype html>
 <form method="post" action="` + panicParsePath + `" enctype="multipart/form-data">
 <textarea name="` + textFormID + `" rows="10" cols="120" wrap="off" autofocus></textarea>
 <p>Alternative file upload: <input type="file" name="` + fileFormID + `"></p>
+<p>
+<label><input type="checkbox" name="` + guessPathsFormID + `"> guess paths (resolves GOROOT/GOPATH on this server; does disk I/O)</label><br>
+<label><input type="checkbox" name="` + needsEnvFormID + `"> show GOROOT/GOPATH/GOTRACEBACK/GODEBUG env panel</label><br>
+<label><input type="checkbox" name="` + nameArgumentsFormID + `"> name recurring pointer arguments</label><br>
+<label><input type="checkbox" name="` + analyzeSourcesFormID + `"> analyze sources</label><br>
+<label>local GOROOT: <input type="text" name="` + localGOROOTFormID + `" size="40"></label><br>
+<label>local GOPATHs (comma separated): <input type="text" name="` + localGOPATHsFormID + `" size="40"></label>
+</p>
 <p><input type="submit" value="Panic Parse"> <input type="submit" value="Hacky Parser (might collapse more)" formaction="` + uploadPath + `"></p>
 </form>
 
+<h2>Diff Two Snapshots</h2>
+<p>Paste two stack dumps captured a few seconds apart to see which stacks are growing, e.g. when investigating a leak.</p>
+<form method="post" action="` + diffPath + `" enctype="multipart/form-data">
+<p>before: <textarea name="` + beforeTextFormID + `" rows="10" cols="120" wrap="off"></textarea></p>
+<p>after: <textarea name="` + afterTextFormID + `" rows="10" cols="120" wrap="off"></textarea></p>
+<p>
+<label>minimum |delta| to show: <input type="number" name="` + thresholdFormID + `" size="4" value="0"></label>
+</p>
+<p><input type="submit" value="Diff"></p>
+</form>
+
 <h2>Example Input</h2>
 <pre>
 goroutine 182 [semacquire]:
@@ -373,6 +693,8 @@ func makeHandlers() http.Handler {
 	mux.HandleFunc("/", handleRoot)
 	mux.HandleFunc(uploadPath, handleUpload)
 	mux.HandleFunc(panicParsePath, handlePanicParse)
+	mux.HandleFunc(apiAggregatePath, handleAPIAggregate)
+	mux.HandleFunc(diffPath, handleDiff)
 	return mux
 }
 
@@ -384,8 +706,19 @@ func serveHTTP(addr string) error {
 
 func main() {
 	addr := flag.String("addr", "", "If set, address for HTTP requests. If not set, reads from stdin.")
+	maxUploadBytesValue := flag.Int64(maxUploadBytesFlag, defaultMaxUploadBytes,
+		"maximum size in bytes accepted for an uploaded stack dump; overridden by "+maxUploadBytesEnvVar+" if set")
 	flag.Parse()
 
+	maxUploadBytes = *maxUploadBytesValue
+	if v := os.Getenv(maxUploadBytesEnvVar); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		maxUploadBytes = parsed
+	}
+
 	if *addr == "" && os.Getenv(portEnvVar) != "" {
 		*addr = ":" + os.Getenv(portEnvVar)
 	}
@@ -397,11 +730,11 @@ func main() {
 		return
 	}
 
-	routines, err := parse(os.Stdin)
+	routines, err := combine.Parse(os.Stdin)
 	if err != nil {
 		panic(err)
 	}
-	err = writeAggregated(os.Stdout, routines)
+	err = writeAggregated(os.Stdout, routines, combine.GroupOptions{})
 	if err != nil {
 		panic(err)
 	}
@@ -6,45 +6,47 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/evanj/combinestacks/combine"
 )
 
 func TestParse(t *testing.T) {
 	type test struct {
 		input    string
-		expected []routine
+		expected []combine.Routine
 	}
 
 	testCases := []test{
-		{plain, []routine{
-			routine{"1", "running",
-				// stack
-				[]frame{
-					frame{"main.main.func1", "0xc000194000", "/Users/ej/combinestacks/stackdemo/stackdemo.go", 26},
+		{plain, []combine.Routine{
+			{Label: "1", State: "running",
+				Stack: []combine.Frame{
+					{Function: "main.main.func1", Args: "0xc000194000", File: "/Users/ej/combinestacks/stackdemo/stackdemo.go", Line: 26},
 				},
-				// created
-				frame{"main.main", "", "/Users/ej/combinestacks/stackdemo/stackdemo.go", 25}},
+				Created: combine.Frame{Function: "main.main", File: "/Users/ej/combinestacks/stackdemo/stackdemo.go", Line: 25}},
 		}},
-		{unavailable, []routine{
-			routine{"12345", "running", nil, frame{"github.com/example/golang.org/x/sync/errgroup.(*Group).Go", "",
-				"###/go/src/github.com/example/golang.org/x/sync/errgroup/errgroup.go", 55}},
+		{unavailable, []combine.Routine{
+			{Label: "12345", State: "running", Created: combine.Frame{
+				Function: "github.com/example/golang.org/x/sync/errgroup.(*Group).Go",
+				File:     "###/go/src/github.com/example/golang.org/x/sync/errgroup/errgroup.go",
+				Line:     55,
+			}},
 		}},
-		{go117format, []routine{
-			routine{"1", "running",
-				// stack
-				[]frame{
-					frame{"runtime/pprof.writeGoroutineStacks", "{0x710780, 0xc000010098}", "/home/ej/go/src/runtime/pprof/pprof.go", 693},
-					frame{"runtime/pprof.writeGoroutine", "{0x710780, 0xc000010098}, 0x8cc680", "/home/ej/go/src/runtime/pprof/pprof.go", 682},
+		{go117format, []combine.Routine{
+			{Label: "1", State: "running",
+				Stack: []combine.Frame{
+					{Function: "runtime/pprof.writeGoroutineStacks", Args: "{0x710780, 0xc000010098}", File: "/home/ej/go/src/runtime/pprof/pprof.go", Line: 693},
+					{Function: "runtime/pprof.writeGoroutine", Args: "{0x710780, 0xc000010098}, 0x8cc680", File: "/home/ej/go/src/runtime/pprof/pprof.go", Line: 682},
 				},
-				// created
-				frame{},
+				Created: combine.Frame{},
 			}},
 		}}
 
 	for i, testCase := range testCases {
-		output, err := parse(strings.NewReader(testCase.input))
+		output, err := combine.Parse(strings.NewReader(testCase.input))
 		if err != nil {
 			t.Errorf("%d: failed to parse: %s", i, err.Error())
 			continue
@@ -135,11 +137,257 @@ func TestFileUpload(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !bytes.Contains(bodyBytes, []byte("state=[running]")) {
+	if !bytes.Contains(bodyBytes, []byte("state=[running:1]")) {
+		t.Error("unexpected body:", string(bodyBytes))
+	}
+}
+
+func TestPlainTextUpload(t *testing.T) {
+	s := httptest.NewServer(makeHandlers())
+	defer s.Close()
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+uploadPath, strings.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.Status)
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bodyBytes, []byte("state=[running:1]")) {
+		t.Error("unexpected body:", string(bodyBytes))
+	}
+}
+
+func TestStreamedMultipartUpload(t *testing.T) {
+	s := httptest.NewServer(makeHandlers())
+	defer s.Close()
+
+	reqBuf := &bytes.Buffer{}
+	reqWriter := multipart.NewWriter(reqBuf)
+	w, err := reqWriter.CreateFormFile(fileFormID, "example.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reqWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+uploadPath+"?stream=1", reqBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", reqWriter.FormDataContentType())
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.Status)
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bodyBytes, []byte("state=[running:1]")) {
+		t.Error("unexpected body:", string(bodyBytes))
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	s := httptest.NewServer(makeHandlers())
+	defer s.Close()
+
+	originalMaxUploadBytes := maxUploadBytes
+	maxUploadBytes = 4
+	defer func() { maxUploadBytes = originalMaxUploadBytes }()
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+uploadPath, strings.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal("unexpected status", resp.Status)
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bodyBytes, []byte(`"max_upload_bytes":4`)) {
 		t.Error("unexpected body:", string(bodyBytes))
 	}
 }
 
+func TestStateHistogram(t *testing.T) {
+	s := httptest.NewServer(makeHandlers())
+	defer s.Close()
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+uploadPath, strings.NewReader(plainMixedStates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bodyBytes, []byte("By state: running:1, semacquire:1")) {
+		t.Error("missing top-level state summary, got:", string(bodyBytes))
+	}
+	if !bytes.Contains(bodyBytes, []byte("state=[running:1, semacquire:1]")) {
+		t.Error("missing per-bucket state histogram, got:", string(bodyBytes))
+	}
+}
+
+func TestExcludeState(t *testing.T) {
+	s := httptest.NewServer(makeHandlers())
+	defer s.Close()
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+uploadPath+"?exclude=semacquire", strings.NewReader(plainMixedStates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bodyBytes, []byte("Found 1 total goroutines")) {
+		t.Error("expected the semacquire goroutine to be excluded, got:", string(bodyBytes))
+	}
+	if bytes.Contains(bodyBytes, []byte("semacquire")) {
+		t.Error("excluded state still present in body:", string(bodyBytes))
+	}
+}
+
+func TestSplitByState(t *testing.T) {
+	s := httptest.NewServer(makeHandlers())
+	defer s.Close()
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+uploadPath+"?splitByState=1", strings.NewReader(plainMixedStates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bodyBytes, []byte("state=[running:1]")) ||
+		!bytes.Contains(bodyBytes, []byte("state=[semacquire:1]")) {
+		t.Error("expected two separate single-state buckets, got:", string(bodyBytes))
+	}
+}
+
+func TestDiff(t *testing.T) {
+	s := httptest.NewServer(makeHandlers())
+	defer s.Close()
+
+	form := url.Values{
+		beforeTextFormID: {plain},
+		afterTextFormID:  {plainTwice},
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL+diffPath, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.Status)
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bodyBytes, []byte(`"before_count":1`)) ||
+		!bytes.Contains(bodyBytes, []byte(`"after_count":2`)) ||
+		!bytes.Contains(bodyBytes, []byte(`"delta":1`)) {
+		t.Error("unexpected body:", string(bodyBytes))
+	}
+}
+
+func TestDiffThreshold(t *testing.T) {
+	s := httptest.NewServer(makeHandlers())
+	defer s.Close()
+
+	form := url.Values{
+		beforeTextFormID: {plain},
+		afterTextFormID:  {plainTwice},
+		thresholdFormID:  {"2"},
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL+diffPath, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.Status)
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bodyBytes, []byte("[]\n")) {
+		t.Error("expected the delta=1 bucket to be filtered out, got:", string(bodyBytes))
+	}
+}
+
 const plain = `goroutine 1 [running]:
 main.main.func1(0xc000194000)
 	/Users/ej/combinestacks/stackdemo/stackdemo.go:26 +0x76
@@ -147,6 +395,37 @@ created by main.main
 	/Users/ej/combinestacks/stackdemo/stackdemo.go:25 +0x647
 `
 
+// plainTwice is plain's stack duplicated under a second goroutine ID, used
+// to exercise a bucket whose count grows between two diffed snapshots.
+const plainTwice = `goroutine 1 [running]:
+main.main.func1(0xc000194000)
+	/Users/ej/combinestacks/stackdemo/stackdemo.go:26 +0x76
+created by main.main
+	/Users/ej/combinestacks/stackdemo/stackdemo.go:25 +0x647
+
+goroutine 2 [running]:
+main.main.func1(0xc000194000)
+	/Users/ej/combinestacks/stackdemo/stackdemo.go:26 +0x76
+created by main.main
+	/Users/ej/combinestacks/stackdemo/stackdemo.go:25 +0x647
+`
+
+// plainMixedStates has two goroutines sharing a stack but parked in
+// different states, used to exercise per-bucket state histograms and the
+// include/exclude/splitByState query parameters.
+const plainMixedStates = `goroutine 1 [running]:
+main.main.func1(0xc000194000)
+	/Users/ej/combinestacks/stackdemo/stackdemo.go:26 +0x76
+created by main.main
+	/Users/ej/combinestacks/stackdemo/stackdemo.go:25 +0x647
+
+goroutine 2 [semacquire]:
+main.main.func1(0xc000194000)
+	/Users/ej/combinestacks/stackdemo/stackdemo.go:26 +0x76
+created by main.main
+	/Users/ej/combinestacks/stackdemo/stackdemo.go:25 +0x647
+`
+
 const unavailable = `
 extra: goroutine 12345 [running]:
 extra: ###goroutine running on other thread; stack unavailable
@@ -4,24 +4,65 @@ import (
 	"io"
 	"log"
 	"sort"
+	"sync"
 
 	"github.com/evanj/combinestacks/forked/panicparse/internal/htmlstack"
 	"github.com/evanj/combinestacks/forked/panicparse/stack"
 )
 
+// rootCache holds the most recent directory index ProcessHTML built, so that
+// a long-running process (e.g. a server symbolizing live panics) calling
+// ProcessHTML repeatedly against the same LocalGOROOT/LocalGOPATHs reuses it
+// instead of paying stack.Opts' directory walk on every call. See
+// stack.Opts.Cache.
+var rootCache struct {
+	mu  sync.Mutex
+	ctx *stack.Context
+}
+
+// Options controls how ProcessHTML parses and renders a stack dump. It
+// mirrors the subset of panicparse's stack.Opts that callers can set.
+type Options struct {
+	// GuessPaths enables rebase: stack.ParseDumpWithOpts resolves
+	// RemoteGOROOT/RemoteGOPATHs against LocalGOROOT/LocalGOPATHs, which does
+	// disk I/O.
+	GuessPaths bool
+	// NeedsEnv includes the GOROOT/GOPATH/GOTRACEBACK/GODEBUG panel in the
+	// rendered HTML, which is useful when troubleshooting why a dump wasn't
+	// fully symbolized.
+	NeedsEnv bool
+
+	// NameArguments, AnalyzeSources, LocalGOROOT and LocalGOPATHs correspond
+	// to the stack.Opts fields of the same name; see there for what each one
+	// controls.
+	NameArguments  bool
+	AnalyzeSources bool
+	LocalGOROOT    string
+	LocalGOPATHs   []string
+}
+
 // ProcessHTML parses stacks from in and writes HTML to out.
-func ProcessHTML(in io.Reader, out io.Writer) error {
+func ProcessHTML(in io.Reader, out io.Writer, opts Options) error {
+	rootCache.mu.Lock()
+	cache := rootCache.ctx
+	rootCache.mu.Unlock()
+
 	// Mostly stolen from panicparse/internal.process
-	const rebase = false
-	c, err := stack.ParseDump(in, out, rebase)
+	c, err := stack.ParseDumpWithOpts(in, out, stack.Opts{
+		GuessPaths:     opts.GuessPaths,
+		NameArguments:  opts.NameArguments,
+		AnalyzeSources: opts.AnalyzeSources,
+		LocalGOROOT:    opts.LocalGOROOT,
+		LocalGOPATHs:   opts.LocalGOPATHs,
+		Cache:          cache,
+	})
 	if c == nil || err != nil {
 		return err
 	}
-	if rebase {
-		log.Printf("GOROOT=%s", c.GOROOT)
-		log.Printf("GOPATH=%s", c.GOPATHs)
+	if opts.GuessPaths {
+		log.Printf("GOROOT=%s", c.RemoteGOROOT)
+		log.Printf("GOPATH=%s", c.RemoteGOPATHs)
 	}
-	const needsEnv = false
 
 	s := stack.AnyPointer
 	buckets := stack.Aggregate(c.Goroutines, s)
@@ -31,5 +72,16 @@ func ProcessHTML(in io.Reader, out io.Writer) error {
 		return len(buckets[i].IDs) > len(buckets[j].IDs)
 	})
 
-	return htmlstack.WriteBuckets(out, buckets, needsEnv, false)
+	if opts.GuessPaths {
+		// Drop the parsed goroutines before caching c: only its directory index
+		// and LocalGOROOT/LocalGOPATHs are needed to serve a later call, and
+		// dropping them here avoids keeping this dump's full parse alive until
+		// the next call replaces the cache.
+		c.Goroutines = nil
+		rootCache.mu.Lock()
+		rootCache.ctx = c
+		rootCache.mu.Unlock()
+	}
+
+	return htmlstack.WriteBuckets(out, buckets, opts.NeedsEnv, false)
 }
@@ -12,43 +12,66 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	"golang.org/x/mod/modfile"
 )
 
 // Context is a parsing context.
 //
-// It contains the deduced GOROOT and GOPATH, if guesspaths is true.
+// It contains the deduced RemoteGOROOT and RemoteGOPATHs, if Opts.GuessPaths
+// is true.
 type Context struct {
 	// Goroutines is the Goroutines found.
 	//
 	// They are in the order that they were printed.
 	Goroutines []*Goroutine
 
-	// GOROOT is the GOROOT as detected in the traceback, not the on the host.
+	// RemoteGOROOT is the GOROOT as detected in the traceback, as opposed to
+	// the one on the host running this code (see Opts.LocalGOROOT).
 	//
 	// It can be empty if no root was determined, for example the traceback
 	// contains only non-stdlib source references.
 	//
-	// Empty is guesspaths was false.
-	GOROOT string
-	// GOPATHs is the GOPATH as detected in the traceback, with the value being
-	// the corresponding path mapped to the host.
+	// Empty if Opts.GuessPaths was false.
+	RemoteGOROOT string
+	// RemoteGOPATHs is the GOPATH as detected in the traceback, with the
+	// value being the corresponding path mapped to the host (see
+	// Opts.LocalGOPATHs).
 	//
 	// It can be empty if only stdlib code is in the traceback or if no local
 	// sources were matched up. In the general case there is only one entry in
 	// the map.
 	//
-	// Nil is guesspaths was false.
-	GOPATHs map[string]string
+	// Nil if Opts.GuessPaths was false.
+	RemoteGOPATHs map[string]string
+
+	// LocalGoWorkspaceRoot is the directory containing the go.work found
+	// above the primary module, if any. Empty if the traceback's sources
+	// aren't rooted in a go.work workspace, or if no module was found at all.
+	LocalGoWorkspaceRoot string
+	// LocalGoModules maps each additional module root discovered while
+	// resolving localGomoduleRoot to its import path: every module listed in
+	// LocalGoWorkspaceRoot's go.work "use" stanza, plus the on-disk target of
+	// any "replace" directive in a visited go.mod that points at a local
+	// path. findRoots treats a file under any of these roots as found, the
+	// same way it treats one under localGomoduleRoot.
+	LocalGoModules map[string]string
 
 	// localGomoduleRoot is the root directory containing go.mod. It is
 	// considered to be the primary project containing the main executable. It is
@@ -64,6 +87,106 @@ type Context struct {
 	localgoroot string
 	// localgopaths is GOPATH with "/" as path separator. No trailing "/".
 	localgopaths []string
+
+	// index is the directory index findRoots resolves frames against. It is
+	// built, or reused from Opts.Cache, by ParseDumpWithOpts before it calls
+	// findRoots; see RootIndex and Opts.Cache.
+	index *RootIndex
+
+	// pathMatching is Opts.PathMatching, copied here so findRoots can see it.
+	pathMatching PathMatching
+}
+
+// defaultMaxLineSize is Opts.MaxLineSize's default: lines over this length
+// will not be accepted and are instead streamed verbatim to out.
+const defaultMaxLineSize = 16 * 1024
+
+// streamDumpRootSampleSize caps how many goroutines ParseDumpWithOpts
+// samples to guess RemoteGOROOT/RemoteGOPATHs when OnGoroutine is set.
+// Unlike the default mode, which can look at every goroutine once the whole
+// dump is in memory, streaming mode has to decide from a prefix of the dump
+// without buffering the rest of it.
+const streamDumpRootSampleSize = 100
+
+// PathMatching controls how findRoots compares a stack dump's frame paths
+// against the local directory index built from LocalGOROOT/LocalGOPATHs.
+// The default, CaseSensitive, is correct when the dump and the local
+// checkout agree on case, which holds for same-OS use; CaseInsensitive and
+// Auto exist for a dump produced on a different OS than the one resolving
+// it, e.g. a Windows GOTRACEBACK symbolized from a Linux checkout.
+type PathMatching int
+
+const (
+	// CaseSensitive compares path segments byte-for-byte. This is the zero
+	// value and the fastest option.
+	CaseSensitive PathMatching = iota
+	// CaseInsensitive folds case before comparing path segments, for a dump
+	// produced on a case-insensitive filesystem (Windows, default macOS)
+	// resolved against a checkout that may disagree with it on casing.
+	CaseInsensitive
+	// Auto tries CaseSensitive first and only falls back to CaseInsensitive
+	// for a frame the sensitive pass didn't resolve, so a dump that agrees
+	// with the local checkout on case pays no extra cost.
+	Auto
+)
+
+// Opts configures ParseDumpWithOpts.
+type Opts struct {
+	// LocalGOROOT overrides the host's GOROOT (normally runtime.GOROOT())
+	// used to resolve RemoteGOROOT and each Call's local path. Empty means
+	// use the host's own GOROOT.
+	LocalGOROOT string
+	// LocalGOPATHs overrides the host's GOPATH entries (normally $GOPATH,
+	// see getGOPATHs) used the same way as LocalGOROOT. Nil means use the
+	// host's own GOPATH.
+	LocalGOPATHs []string
+	// GuessPaths enables resolving RemoteGOROOT/RemoteGOPATHs against
+	// LocalGOROOT/LocalGOPATHs; see ParseDump.
+	GuessPaths bool
+	// NameArguments gates the O(n²) pass that gives pointer argument values
+	// recurring across calls a shared name. Disable it
+	// when processing dumps with many goroutines and the names aren't
+	// needed, to avoid paying for it.
+	NameArguments bool
+	// AnalyzeSources, when combined with GuessPaths, opens each Call's
+	// resolved local source file to attach the declared parameter names and
+	// types to its arguments (Call.NamedArgs), which aren't derivable from
+	// the traceback text alone. Local variables are not reported.
+	// This does more disk I/O than GuessPaths alone.
+	AnalyzeSources bool
+	// MaxLineSize bounds how long a single traceback line can be before it
+	// is treated as junk and streamed verbatim to out instead of being
+	// parsed. Real cgo and race reports can have much longer lines than a
+	// plain panic dump, so this is worth raising for those. Zero means
+	// defaultMaxLineSize.
+	MaxLineSize int
+	// OnGoroutine, if set, is called with each goroutine as soon as it is
+	// fully parsed, which is then dropped instead of being kept in the
+	// returned Context.Goroutines. This bounds peak memory use when
+	// ingesting a dump with 100k+ goroutines, at the cost of GuessPaths only
+	// being able to sample the first streamDumpRootSampleSize goroutines
+	// (see StreamDump) and streamed goroutines never getting
+	// updateLocations or AnalyzeSources applied to them, since the
+	// local/stdlib path resolution both depend on isn't known until the
+	// sample is in.
+	OnGoroutine func(*Goroutine) error
+
+	// MaxWalkDepth bounds how many directories deep buildRootIndex descends
+	// below LocalGOROOT/LocalGOPATHs when GuessPaths is set. Zero means
+	// unbounded. Lower this on huge GOPATHs where a full walk is too costly.
+	MaxWalkDepth int
+	// WalkConcurrency is how many goroutines buildRootIndex uses to walk
+	// LocalGOROOT/LocalGOPATHs concurrently. Zero means runtime.NumCPU().
+	WalkConcurrency int
+	// PathMatching controls how findRoots compares a frame's path against
+	// the directory index when GuessPaths is set. Zero means CaseSensitive.
+	PathMatching PathMatching
+	// Cache, if set, is a prior call's Context: if its LocalGOROOT/
+	// LocalGOPATHs and MaxWalkDepth match this call's, its directory index is reused instead
+	// of walking the disk again. Set this in a long-running process that
+	// calls ParseDumpWithOpts repeatedly against the same local checkout,
+	// e.g. a server symbolizing live panics, to pay the walk's cost once.
+	Cache *Context
 }
 
 // ParseDump processes the output from runtime.Stack().
@@ -74,27 +197,101 @@ type Context struct {
 // assumes there is junk before the actual stack trace. The junk is streamed to
 // out.
 //
-// If guesspaths is false, no guessing of GOROOT and GOPATH is done, and Call
-// entites do not have LocalSrcPath and IsStdlib filled in. If true, be warned
-// that file presence is done, which means some level of disk I/O.
+// If guesspaths is false, no guessing of RemoteGOROOT and RemoteGOPATHs is
+// done, and Call entites do not have LocalSrcPath and IsStdlib filled in. If
+// true, be warned that file presence is done, which means some level of disk
+// I/O.
+//
+// ParseDump is a compatibility shim over ParseDumpWithOpts for existing call
+// sites: it always names arguments, matching ParseDump's historical
+// behavior, from before Opts.NameArguments made that optional.
 func ParseDump(r io.Reader, out io.Writer, guesspaths bool) (*Context, error) {
-	goroutines, err := parseDump(r, out)
-	if len(goroutines) == 0 {
+	return ParseDumpWithOpts(r, out, Opts{GuessPaths: guesspaths, NameArguments: true})
+}
+
+// StreamDump is like ParseDump, but instead of accumulating every goroutine
+// into Context.Goroutines before returning, it calls fn with each one as
+// soon as it is fully parsed and then drops it, so ingesting a dump with
+// 100k+ goroutines doesn't require holding all of them in memory at once.
+// The returned Context still carries RemoteGOROOT, RemoteGOPATHs and
+// localGomoduleRoot, but Context.Goroutines is always empty; see
+// Opts.OnGoroutine for the guesspaths caveat that comes with streaming.
+func StreamDump(r io.Reader, out io.Writer, guesspaths bool, fn func(*Goroutine) error) (*Context, error) {
+	return ParseDumpWithOpts(r, out, Opts{GuessPaths: guesspaths, NameArguments: true, OnGoroutine: fn})
+}
+
+// ParseDumpWithOpts is ParseDump/StreamDump's shared implementation; see Opts
+// for what each option controls.
+func ParseDumpWithOpts(r io.Reader, out io.Writer, opts Opts) (*Context, error) {
+	maxLineSize := opts.MaxLineSize
+	if maxLineSize <= 0 {
+		maxLineSize = defaultMaxLineSize
+	}
+
+	var rootSample []*Goroutine
+	s := scanningState{}
+	if opts.OnGoroutine != nil {
+		fn := opts.OnGoroutine
+		s.onGoroutine = func(g *Goroutine) error {
+			// Named here, per goroutine, rather than in the batch
+			// nameArguments(rootSample) call below: that call only ever sees
+			// the sample, so anything past streamDumpRootSampleSize would
+			// otherwise reach fn with its arguments unnamed.
+			if opts.NameArguments {
+				nameArguments([]*Goroutine{g})
+			}
+			if len(rootSample) < streamDumpRootSampleSize {
+				rootSample = append(rootSample, g)
+			}
+			return fn(g)
+		}
+	}
+
+	goroutines, err := parseDump(r, out, maxLineSize, &s)
+	if opts.OnGoroutine == nil {
+		rootSample = goroutines
+		if opts.NameArguments {
+			nameArguments(rootSample)
+		}
+	}
+	if len(rootSample) == 0 && len(goroutines) == 0 {
 		return nil, err
 	}
+
+	localgoroot := opts.LocalGOROOT
+	if localgoroot == "" {
+		localgoroot = runtime.GOROOT()
+	}
+	localgopaths := opts.LocalGOPATHs
+	if localgopaths == nil {
+		localgopaths = getGOPATHs()
+	}
 	c := &Context{
 		Goroutines:   goroutines,
-		localgoroot:  strings.Replace(runtime.GOROOT(), "\\", "/", -1),
-		localgopaths: getGOPATHs(),
+		localgoroot:  strings.Replace(localgoroot, "\\", "/", -1),
+		localgopaths: localgopaths,
+		pathMatching: opts.PathMatching,
 	}
-	nameArguments(goroutines)
 	// Corresponding local values on the host for Context.
-	if guesspaths {
-		c.findRoots()
-		for _, r := range c.Goroutines {
+	if opts.GuessPaths {
+		if opts.Cache != nil && opts.Cache.index != nil &&
+			opts.Cache.localgoroot == c.localgoroot && sameGOPATHs(opts.Cache.localgopaths, c.localgopaths) &&
+			opts.Cache.index.maxWalkDepth == opts.MaxWalkDepth {
+			c.index = opts.Cache.index
+		} else {
+			c.index = buildRootIndex(c.localgoroot, c.localgopaths, opts.MaxWalkDepth, opts.WalkConcurrency)
+		}
+		c.findRoots(rootSample)
+		for _, g := range c.Goroutines {
 			// Note that this is important to call it even if
-			// c.GOROOT == c.localgoroot.
-			r.updateLocations(c.GOROOT, c.localgoroot, c.localGomoduleRoot, c.gomodImportPath, c.GOPATHs)
+			// c.RemoteGOROOT == c.localgoroot.
+			g.updateLocations(c.RemoteGOROOT, c.localgoroot, c.localGomoduleRoot, c.gomodImportPath, c.RemoteGOPATHs)
+		}
+		if opts.AnalyzeSources {
+			// analyzeSources is defined further down in this file, alongside
+			// analyzeCall/funcAt/flattenParams; see there for what it adds to
+			// each Call.
+			analyzeSources(c.Goroutines)
 		}
 	}
 	return c, err
@@ -102,10 +299,9 @@ func ParseDump(r io.Reader, out io.Writer, guesspaths bool) (*Context, error) {
 
 // Private stuff.
 
-func parseDump(r io.Reader, out io.Writer) ([]*Goroutine, error) {
-	// Lines over 16k in length will not be accepted.
-	br := bufio.NewReaderSize(r, 16*1024)
-	s := scanningState{}
+func parseDump(r io.Reader, out io.Writer, maxLineSize int, s *scanningState) ([]*Goroutine, error) {
+	// Lines over maxLineSize in length will not be accepted.
+	br := bufio.NewReaderSize(r, maxLineSize)
 	wasLong := false
 	for {
 		slice, err := br.ReadSlice('\n')
@@ -124,6 +320,9 @@ func parseDump(r io.Reader, out io.Writer) ([]*Goroutine, error) {
 				}
 			}
 			if err == io.EOF {
+				if err1 = s.flush(); err1 != nil {
+					return s.goroutines, err1
+				}
 				return s.goroutines, nil
 			}
 		}
@@ -148,6 +347,8 @@ var (
 	writeCap   = []byte("Write")
 	writeLow   = []byte("write")
 	threeDots  = []byte("...")
+	// gotSignalArrived
+	signalArrived = []byte("signal arrived during cgo execution")
 )
 
 // These are effectively constants.
@@ -174,9 +375,10 @@ var (
 	//   _func.entry is not set.
 	// - C calls may have fp=0x123 sp=0x123 appended. I think it normally happens
 	//   when a signal is not correctly handled. It is printed with m.throwing>0.
-	//   These are discarded.
-	// - For cgo, the source file may be "??".
-	reFile = regexp.MustCompile("^(?:\t| +)(\\?\\?|\\<autogenerated\\>|.+\\.(?:c|go|s))\\:(\\d+)(?:| \\+0x[0-9a-f]+)(?:| fp=0x[0-9a-f]+ sp=0x[0-9a-f]+(?:| pc=0x[0-9a-f]+))$")
+	//   They are kept on Call.FP/SP/PC rather than discarded, since they are
+	//   the only way to correlate a stripped binary's frame with addr2line.
+	// - For cgo, the source file may be "??"; Call.IsCgo is set in that case.
+	reFile = regexp.MustCompile("^(?:\t| +)(\\?\\?|\\<autogenerated\\>|.+\\.(?:c|go|s))\\:(\\d+)(?:| \\+0x[0-9a-f]+)(?:| fp=(0x[0-9a-f]+) sp=(0x[0-9a-f]+)(?:| pc=(0x[0-9a-f]+)))$")
 
 	// gotCreated
 	// Sadly, it doesn't note the goroutine number so we could cascade them per
@@ -191,8 +393,6 @@ var (
 	// for the code generating these messages. Please note only the block in
 	//   #else  // #if !SANITIZER_GO
 	// is used.
-	// TODO(maruel): "    [failed to restore the stack]\n\n"
-	// TODO(maruel): "Global var %s of size %zu at %p declared at %s:%zu\n"
 
 	// gotRaceOperationHeader
 	reRaceOperationHeader = regexp.MustCompile(`^(Read|Write) at (0x[0-9a-f]+) by goroutine (\d+):$`)
@@ -205,15 +405,99 @@ var (
 
 	// TODO(maruel): Use it.
 	//reRacePreviousOperationMainHeader = regexp.MustCompile("^Previous (read|write) at (0x[0-9a-f]+) by main goroutine:$")
+
+	// gotRaceOperationStackUnavailable
+	// tsan prints this placeholder instead of a function/file pair when it
+	// fails to symbolize the race operation's stack.
+	reRaceStackUnavailable = regexp.MustCompile(`^\[failed to restore the stack\]$`)
+
+	// gotRaceOperationGlobal
+	// Printed instead of a function/file pair when the race touched a
+	// package-level global rather than a stack variable.
+	reRaceGlobal = regexp.MustCompile(`^Global var (.+) of size (\d+) at (0x[0-9a-f]+) declared at (.+):(\d+)$`)
+
+	// gotSignalArrived
+	// Signature: "[signal SIGSEGV: segmentation violation code=0x1 addr=0x18 pc=0x47e5ce]"
+	reSignalInfo = regexp.MustCompile(`^\[signal (\w+): (.+?) code=(0x[0-9a-f]+) addr=(0x[0-9a-f]+) pc=(0x[0-9a-f]+)\]$`)
 )
 
+// RaceGlobal describes a package-level global variable touched by a data
+// race, parsed from a "Global var ... declared at ..." line. It stands in
+// for the usual function+file frames on the goroutine it is attached to,
+// since a global access has no call stack of its own.
+type RaceGlobal struct {
+	Name     string
+	Size     uint64
+	Addr     uint64
+	DeclFile string
+	DeclLine int
+}
+
+// newRaceGlobal parses a reRaceGlobal match into a RaceGlobal.
+func newRaceGlobal(match [][]byte) (*RaceGlobal, error) {
+	size, err := strconv.ParseUint(string(match[2]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse global size on line: %q", bytes.TrimSpace(match[0]))
+	}
+	addr, err := strconv.ParseUint(string(match[3]), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse global address on line: %q", bytes.TrimSpace(match[0]))
+	}
+	line, ok := atou(match[5])
+	if !ok {
+		return nil, fmt.Errorf("failed to parse global declaration line on line: %q", bytes.TrimSpace(match[0]))
+	}
+	return &RaceGlobal{
+		Name:     string(match[1]),
+		Size:     size,
+		Addr:     addr,
+		DeclFile: string(match[4]),
+		DeclLine: line,
+	}, nil
+}
+
+// SignalInfo is the "[signal SIGSEGV: ...]" line the runtime prints ahead of
+// a goroutine's header when a fatal signal is caught during cgo execution,
+// e.g. under GOTRACEBACK=crash. It is attached to the goroutine whose header
+// immediately follows it.
+type SignalInfo struct {
+	Signal      string
+	Description string
+	Code        uint64
+	Addr        uint64
+	PC          uint64
+}
+
+// newSignalInfo parses a reSignalInfo match into a SignalInfo.
+func newSignalInfo(match [][]byte) (*SignalInfo, error) {
+	code, err := strconv.ParseUint(string(match[3]), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signal code on line: %q", bytes.TrimSpace(match[0]))
+	}
+	addr, err := strconv.ParseUint(string(match[4]), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signal address on line: %q", bytes.TrimSpace(match[0]))
+	}
+	pc, err := strconv.ParseUint(string(match[5]), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signal pc on line: %q", bytes.TrimSpace(match[0]))
+	}
+	return &SignalInfo{
+		Signal:      string(match[1]),
+		Description: string(match[2]),
+		Code:        code,
+		Addr:        addr,
+		PC:          pc,
+	}, nil
+}
+
 // state is the state of the scan to detect and process a stack trace.
 type state int
 
 // Initial state is normal. Other states are when a stack trace is detected.
 const (
 	// Outside a stack trace.
-	// to: gotRoutineHeader, raceHeader1
+	// to: gotRoutineHeader, raceHeader1, gotSignalArrived
 	normal state = iota
 
 	// Panic stack trace:
@@ -221,12 +505,21 @@ const (
 	// Signature: ""
 	// An empty line between goroutines.
 	// from: gotFileCreated, gotFileFunc
-	// to: gotRoutineHeader, normal
+	// to: gotRoutineHeader, normal, gotSignalArrived
 	betweenRoutine
+	// Constant: signalArrived
+	// Signature: "signal arrived during cgo execution"
+	// Prolog to a "[signal SIGSEGV: ...]" line, itself the prolog to the
+	// goroutine header it describes (see GOTRACEBACK=crash). The parsed
+	// SignalInfo is held on scanningState.pendingSignal until that header is
+	// seen, since the line carries no goroutine ID of its own.
+	// from: normal, betweenRoutine
+	// to: betweenRoutine, normal
+	gotSignalArrived
 	// Regexp: reRoutineHeader
 	// Signature: "goroutine 1 [running]:"
 	// Goroutine header was found.
-	// from: normal
+	// from: normal, betweenRoutine
 	// to: gotUnavail, gotFunc
 	gotRoutineHeader
 	// Regexp: reFunc
@@ -276,8 +569,23 @@ const (
 	// Signature: "Read at 0x00c0000e4030 by goroutine 7:"
 	// A race operation was found.
 	// from: gotRaceHeader2
-	// to: normal, gotRaceOperationFunc
+	// to: normal, gotRaceOperationFunc, gotRaceOperationStackUnavailable,
+	//     gotRaceOperationGlobal
 	gotRaceOperationHeader
+	// Regexp: reRaceStackUnavailable
+	// Signature: "    [failed to restore the stack]"
+	// tsan failed to symbolize the race operation's stack; StackUnavailable
+	// is set on the goroutine so consumers can render a placeholder frame.
+	// from: gotRaceOperationHeader
+	// to: normal, betweenRaceOperations
+	gotRaceOperationStackUnavailable
+	// Regexp: reRaceGlobal
+	// Signature: "Global var main.count of size 8 at 0x000001234567 declared at /foo/bar.go:12"
+	// The race touched a package-level global instead of a stack variable;
+	// there is no function/file pair to parse.
+	// from: gotRaceOperationHeader
+	// to: normal, betweenRaceOperations
+	gotRaceOperationGlobal
 	// Regexp: reFunc
 	// Signature: "  main.panicRace.func1()"
 	// Function that caused the race.
@@ -324,12 +632,85 @@ const (
 // scanningState is the state of the scan to detect and process a stack trace
 // and stores the traces found.
 type scanningState struct {
-	// goroutines contains all the goroutines found.
+	// goroutines contains all the goroutines found. In streaming mode (see
+	// onGoroutine), this only ever holds the goroutine(s) still being
+	// parsed; completed ones are handed to onGoroutine and dropped.
 	goroutines []*Goroutine
 
 	state          state
 	prefix         []byte
 	goroutineIndex int
+
+	// pendingSignal holds a SignalInfo parsed from a "[signal ...]" prolog
+	// until the goroutine header that follows it is seen, since the prolog
+	// itself carries no goroutine ID to attach to.
+	pendingSignal *SignalInfo
+
+	// goroutineCount is the total number of goroutines completed so far,
+	// including ones already dropped from goroutines by onGoroutine. Unlike
+	// len(goroutines), this keeps counting up even when completed
+	// goroutines are dropped, so First can still be computed correctly.
+	goroutineCount int
+	// onGoroutine, if set, is called with each goroutine as soon as it is
+	// fully parsed, which is then dropped from goroutines; see
+	// Opts.OnGoroutine.
+	onGoroutine func(*Goroutine) error
+}
+
+// completeGoroutine marks the in-progress (non-race) goroutine as done: it
+// bumps goroutineCount and, if onGoroutine is set, hands it off and drops
+// it from goroutines.
+func (s *scanningState) completeGoroutine() error {
+	if len(s.goroutines) == 0 {
+		return nil
+	}
+	s.goroutineCount++
+	if s.onGoroutine == nil {
+		return nil
+	}
+	g := s.goroutines[len(s.goroutines)-1]
+	s.goroutines = s.goroutines[:len(s.goroutines)-1]
+	return s.onGoroutine(g)
+}
+
+// completeRaceBlock marks every goroutine accumulated for the current race
+// report as done, once its closing "==================" footer is seen.
+// Unlike completeGoroutine, this can't fire incrementally: race operations
+// and the goroutines they reference are matched up by ID across the whole
+// report, so none of them can be dropped until the report is fully parsed.
+//
+// The goroutines are detached from s.goroutines before onGoroutine runs, so
+// an error partway through still leaves s.goroutines empty: goroutines
+// already delivered once must not reappear in a later Context.Goroutines.
+func (s *scanningState) completeRaceBlock() error {
+	goroutines := s.goroutines
+	if s.onGoroutine != nil {
+		s.goroutines = nil
+	}
+	for _, g := range goroutines {
+		s.goroutineCount++
+		if s.onGoroutine != nil {
+			if err := s.onGoroutine(g); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush completes whatever goroutine or race report was being parsed when
+// the input ended without a trailing blank line or footer, which scan
+// otherwise relies on to detect that a goroutine's stack, or a race
+// report's set of goroutines, is finished.
+func (s *scanningState) flush() error {
+	switch s.state {
+	case gotRaceOperationHeader, gotRaceOperationStackUnavailable, gotRaceOperationGlobal,
+		gotRaceOperationFunc, gotRaceOperationFile, betweenRaceOperations, betweenRaceGoroutines,
+		gotRaceGoroutineHeader, gotRaceGoroutineFunc, gotRaceGoroutineFile:
+		return s.completeRaceBlock()
+	default:
+		return s.completeGoroutine()
+	}
 }
 
 // scan scans one line, updates goroutines and move to the next state.
@@ -406,9 +787,11 @@ func (s *scanningState) scan(line []byte) ([]byte, error) {
 						SleepMax: sleep,
 						Locked:   locked,
 					},
-					ID:    id,
-					First: len(s.goroutines) == 0,
+					ID:         id,
+					First:      s.goroutineCount == 0,
+					SignalInfo: s.pendingSignal,
 				}
+				s.pendingSignal = nil
 				// Increase performance by always allocating 4 goroutines minimally.
 				if s.goroutines == nil {
 					s.goroutines = make([]*Goroutine, 0, 4)
@@ -426,11 +809,33 @@ func (s *scanningState) scan(line []byte) ([]byte, error) {
 			s.state = gotRaceHeader1
 			return nil, nil
 		}
+		// cgo fatal signal prolog to the next goroutine header; see
+		// GOTRACEBACK=crash.
+		if bytes.Equal(trimmed, signalArrived) {
+			s.state = gotSignalArrived
+			return nil, nil
+		}
 		// Fallthrough.
 		s.state = normal
 		s.prefix = nil
 		return line, nil
 
+	case gotSignalArrived:
+		if match := reSignalInfo.FindSubmatch(trimmed); match != nil {
+			info, err := newSignalInfo(match)
+			if err != nil {
+				return nil, err
+			}
+			s.pendingSignal = info
+			s.state = betweenRoutine
+			return nil, nil
+		}
+		// Like gotRaceHeader1 below: "signal arrived during cgo execution" can
+		// in principle appear in junk that isn't actually this prolog, so fall
+		// back to normal instead of erroring out the rest of the dump.
+		s.state = normal
+		return line, nil
+
 	case gotRoutineHeader:
 		if reUnavail.Match(trimmed) {
 			// Generate a fake stack entry.
@@ -497,7 +902,7 @@ func (s *scanningState) scan(line []byte) ([]byte, error) {
 		}
 		if len(trimmed) == 0 {
 			s.state = betweenRoutine
-			return nil, nil
+			return nil, s.completeGoroutine()
 		}
 		// Back to normal state.
 		s.state = normal
@@ -507,7 +912,7 @@ func (s *scanningState) scan(line []byte) ([]byte, error) {
 	case gotFileCreated:
 		if len(trimmed) == 0 {
 			s.state = betweenRoutine
-			return nil, nil
+			return nil, s.completeGoroutine()
 		}
 		s.state = normal
 		s.prefix = nil
@@ -516,7 +921,7 @@ func (s *scanningState) scan(line []byte) ([]byte, error) {
 	case gotUnavail:
 		if len(trimmed) == 0 {
 			s.state = betweenRoutine
-			return nil, nil
+			return nil, s.completeGoroutine()
 		}
 		if match := reCreated.FindSubmatch(trimmed); match != nil {
 			cur.CreatedBy.Calls = make([]Call, 1)
@@ -564,6 +969,20 @@ func (s *scanningState) scan(line []byte) ([]byte, error) {
 		return line, nil
 
 	case gotRaceOperationHeader:
+		if reRaceStackUnavailable.Match(trimLeftSpace(trimmed)) {
+			cur.StackUnavailable = true
+			s.state = gotRaceOperationStackUnavailable
+			return nil, nil
+		}
+		if match := reRaceGlobal.FindSubmatch(trimLeftSpace(trimmed)); match != nil {
+			g, err := newRaceGlobal(match)
+			if err != nil {
+				return nil, err
+			}
+			cur.RaceGlobal = g
+			s.state = gotRaceOperationGlobal
+			return nil, nil
+		}
 		c := Call{}
 		if found, err := parseFunc(&c, trimLeftSpace(trimmed)); found {
 			// Increase performance by always allocating 4 calls minimally.
@@ -576,6 +995,20 @@ func (s *scanningState) scan(line []byte) ([]byte, error) {
 		}
 		return nil, fmt.Errorf("expected a function after a race operation, got: %q", trimmed)
 
+	case gotRaceOperationStackUnavailable:
+		if len(trimmed) == 0 {
+			s.state = betweenRaceOperations
+			return nil, nil
+		}
+		return nil, fmt.Errorf("expected an empty line after an unavailable race stack, got: %q", trimmed)
+
+	case gotRaceOperationGlobal:
+		if len(trimmed) == 0 {
+			s.state = betweenRaceOperations
+			return nil, nil
+		}
+		return nil, fmt.Errorf("expected an empty line after a race global, got: %q", trimmed)
+
 	case gotRaceOperationFunc:
 		if found, err := parseFile(&cur.Stack.Calls[len(cur.Stack.Calls)-1], trimmed); err != nil {
 			return nil, err
@@ -661,7 +1094,7 @@ func (s *scanningState) scan(line []byte) ([]byte, error) {
 		if bytes.Equal(trimmed, raceHeaderFooter) {
 			// Done.
 			s.state = normal
-			return nil, nil
+			return nil, s.completeRaceBlock()
 		}
 		fallthrough
 
@@ -679,6 +1112,78 @@ func (s *scanningState) scan(line []byte) ([]byte, error) {
 	}
 }
 
+// Arg is one function call argument as printed in a stack trace.
+//
+// Since Go 1.17, runtime.Stack can print an argument as a typed tuple
+// (struct, slice header, interface, etc.) wrapped in "{...}"; that case is
+// represented by Values holding the tuple's own elements instead of a
+// scalar Value. Every argument was a flat hex scalar before Go 1.17, which
+// is simply the case where Values is nil -- so Go 1.16-style traces parse
+// into exactly the same shape they always have.
+type Arg struct {
+	// Value is the scalar value. Unset (zero) when Values is non-nil.
+	Value uint64
+	// IsPtr is a guess, based on Value falling in the range of probable
+	// pointers, since the trace doesn't say which arguments are pointers.
+	IsPtr bool
+	// MovedToHeap and HeapAddr record a Go 1.21+ "@0x..." suffix, printed
+	// when the value the stack holds is actually a pointer to a heap copy.
+	MovedToHeap bool
+	HeapAddr    uint64
+	// Scrubbed is true for the "?" placeholder a GOTRACEBACK=wer trace
+	// prints in place of a redacted argument value.
+	Scrubbed bool
+	// Elided is true if trailing values of this aggregate were cut off by
+	// a "...". Only meaningful when Values is non-nil.
+	Elided bool
+	// Values holds a "{...}" aggregate argument's own elements; nil for a
+	// scalar argument.
+	Values []Arg
+}
+
+// String renders a back to the text it was parsed from.
+func (a Arg) String() string {
+	switch {
+	case a.Scrubbed:
+		return "?"
+	case a.Values != nil:
+		return "{" + (Args{Values: a.Values, Elided: a.Elided}).String() + "}"
+	}
+	s := "0x" + strconv.FormatUint(a.Value, 16)
+	if a.MovedToHeap {
+		s += "@0x" + strconv.FormatUint(a.HeapAddr, 16)
+	}
+	return s
+}
+
+// Args is a call's full, comma-separated argument list.
+type Args struct {
+	Values []Arg
+	// Elided is true if trailing values were cut off by a "...".
+	Elided bool
+}
+
+// String renders args back to the text it was parsed from, e.g.
+// "{0xc0000140a0, 0x3, 0x3}, 0x1".
+func (args Args) String() string {
+	parts := make([]string, 0, len(args.Values)+1)
+	for _, v := range args.Values {
+		parts = append(parts, v.String())
+	}
+	if args.Elided {
+		parts = append(parts, "...")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// String renders c back to the traceback line it was parsed from, e.g.
+// "main.worker({0xc0000140a0, 0x3, 0x3}, 0x1)". It round-trips parseFunc's
+// output; the trailing "+0x..." byte offset and file:line are not part of
+// Call's argument data and are not reproduced here.
+func (c Call) String() string {
+	return c.Func.String() + "(" + c.Args.String() + ")"
+}
+
 // parseFunc only return an error if also returning a Call.
 //
 // Uses reFunc.
@@ -687,30 +1192,118 @@ func parseFunc(c *Call, line []byte) (bool, error) {
 		if err := c.Func.Init(string(match[1])); err != nil {
 			return true, err
 		}
-		for _, a := range bytes.Split(match[2], commaSpace) {
-			if bytes.Equal(a, threeDots) {
-				c.Args.Elided = true
-				continue
-			}
-			if len(a) == 0 {
-				// Remaining values were dropped.
-				break
+		args, err := parseArgs(match[2])
+		if err != nil {
+			return true, fmt.Errorf("%s on line: %q", err, bytes.TrimSpace(line))
+		}
+		c.Args = args
+		return true, nil
+	}
+	return false, nil
+}
+
+// argScrubbed is the literal Go 1.21+ prints in place of an argument value
+// redacted because of GOTRACEBACK=wer.
+var argScrubbed = []byte("?")
+
+// parseArgs tokenizes a call's whole argument list, e.g. the text between
+// the parens in "main.worker({0xc0000140a0, 0x3, 0x3}, 0x1)". It has been a
+// flat, comma-separated list of hex/decimal values since Go 1.0, but Go
+// 1.17 started printing aggregate arguments (structs, slices, interfaces)
+// as a typed tuple wrapped in "{...}", which can itself contain further
+// aggregates; parseArgValues below recurses to handle that. The flat
+// pre-1.17 format is simply the case where no "{" is ever seen, so no
+// separate code path is needed to keep parsing those traces identically.
+func parseArgs(raw []byte) (Args, error) {
+	values, elided, rest, err := parseArgValues(raw)
+	if err != nil {
+		return Args{}, err
+	}
+	if len(rest) != 0 {
+		return Args{}, fmt.Errorf("unexpected trailing data in argument list: %q", rest)
+	}
+	return Args{Values: values, Elided: elided}, nil
+}
+
+// parseArgValues parses a comma-separated argument list up to (but not
+// including) a closing "}" or the end of input. It returns the parsed
+// values, whether the list was cut short by a trailing "...", and whatever
+// of raw it didn't consume (the "}" terminating an aggregate, if any).
+func parseArgValues(raw []byte) ([]Arg, bool, []byte, error) {
+	var values []Arg
+	elided := false
+	first := true
+	for len(raw) != 0 && raw[0] != '}' {
+		if !first {
+			if !bytes.HasPrefix(raw, commaSpace) {
+				return nil, false, nil, fmt.Errorf("expected %q between arguments, got: %q", commaSpace, raw)
 			}
-			v, err := strconv.ParseUint(string(a), 0, 64)
+			raw = raw[len(commaSpace):]
+		}
+		first = false
+
+		switch {
+		case bytes.HasPrefix(raw, threeDots):
+			elided = true
+			raw = raw[len(threeDots):]
+
+		case bytes.HasPrefix(raw, argScrubbed):
+			values = append(values, Arg{Scrubbed: true})
+			raw = raw[len(argScrubbed):]
+
+		case raw[0] == '{':
+			children, childElided, rest, err := parseArgValues(raw[1:])
 			if err != nil {
-				return true, fmt.Errorf("failed to parse int on line: %q", bytes.TrimSpace(line))
+				return nil, false, nil, err
 			}
-			// Increase performance by always allocating 4 values minimally.
-			if c.Args.Values == nil {
-				c.Args.Values = make([]Arg, 0, 4)
+			if len(rest) == 0 || rest[0] != '}' {
+				return nil, false, nil, fmt.Errorf("unterminated aggregate argument starting at: %q", raw)
+			}
+			values = append(values, Arg{Values: children, Elided: childElided})
+			raw = rest[1:]
+
+		default:
+			v, rest, err := parseArgScalar(raw)
+			if err != nil {
+				return nil, false, nil, err
 			}
-			// Assume the stack was generated with the same bitness (32 vs 64) than
-			// the code processing it.
-			c.Args.Values = append(c.Args.Values, Arg{Value: v, IsPtr: v > pointerFloor && v < pointerCeiling})
+			values = append(values, v)
+			raw = rest
 		}
-		return true, nil
 	}
-	return false, nil
+	return values, elided, raw, nil
+}
+
+// parseArgScalar parses one hex or decimal integer token, optionally
+// followed by a Go 1.21 "@0x..." suffix marking the value as moved to the
+// heap, and returns it plus whatever of raw follows the token.
+func parseArgScalar(raw []byte) (Arg, []byte, error) {
+	end := len(raw)
+	if i := bytes.IndexAny(raw, ",}@"); i >= 0 {
+		end = i
+	}
+	tok, rest := raw[:end], raw[end:]
+	v, err := strconv.ParseUint(string(tok), 0, 64)
+	if err != nil {
+		return Arg{}, nil, fmt.Errorf("failed to parse argument %q", tok)
+	}
+	// Assume the stack was generated with the same bitness (32 vs 64) than
+	// the code processing it.
+	a := Arg{Value: v, IsPtr: v > pointerFloor && v < pointerCeiling}
+	if bytes.HasPrefix(rest, []byte("@")) {
+		addrEnd := len(rest)
+		if i := bytes.IndexAny(rest[1:], ",}"); i >= 0 {
+			addrEnd = i + 1
+		}
+		addr, err := strconv.ParseUint(string(rest[1:addrEnd]), 0, 64)
+		if err != nil {
+			return Arg{}, nil, fmt.Errorf("failed to parse heap address %q", rest[1:addrEnd])
+		}
+		a.MovedToHeap = true
+		a.HeapAddr = addr
+		rest = rest[addrEnd:]
+	}
+	return a, rest, nil
 }
 
 // parseFile only return an error if also processing a Call.
@@ -723,19 +1316,36 @@ func parseFile(c *Call, line []byte) (bool, error) {
 			return true, fmt.Errorf("failed to parse int on line: %q", bytes.TrimSpace(line))
 		}
 		c.init(string(match[1]), num)
+		c.IsCgo = string(match[1]) == cgoUnknownSrcPath || strings.HasSuffix(string(match[1]), ".c")
+		fp, err := parseOptionalHex(match[3])
+		if err != nil {
+			return true, fmt.Errorf("failed to parse fp on line: %q", bytes.TrimSpace(line))
+		}
+		sp, err := parseOptionalHex(match[4])
+		if err != nil {
+			return true, fmt.Errorf("failed to parse sp on line: %q", bytes.TrimSpace(line))
+		}
+		pc, err := parseOptionalHex(match[5])
+		if err != nil {
+			return true, fmt.Errorf("failed to parse pc on line: %q", bytes.TrimSpace(line))
+		}
+		c.FP, c.SP, c.PC = fp, sp, pc
 		return true, nil
 	}
 	return false, nil
 }
 
-// hasSrcPrefix returns true if any of s is the prefix of p.
-func hasSrcPrefix(p string, s map[string]string) bool {
-	for prefix := range s {
-		if strings.HasPrefix(p, prefix+"/src/") || strings.HasPrefix(p, prefix+"/pkg/mod/") {
-			return true
-		}
+// cgoUnknownSrcPath is the source file the runtime prints for a frame it
+// can't symbolize, which in practice means a C frame reached through cgo.
+const cgoUnknownSrcPath = "??"
+
+// parseOptionalHex parses a "0x..." token, or returns 0 if raw is empty,
+// since reFile's fp/sp/pc groups are only present on some frames.
+func parseOptionalHex(raw []byte) (uint64, error) {
+	if len(raw) == 0 {
+		return 0, nil
 	}
-	return false
+	return strconv.ParseUint(string(raw), 0, 64)
 }
 
 // getFiles returns all the source files deduped and ordered.
@@ -788,103 +1398,592 @@ func isFile(p string) bool {
 	return err == nil && !i.IsDir()
 }
 
-// rootedIn returns a root if the file split in parts is rooted in root.
+// NamedArg pairs one of a Call's raw traceback arguments with the parameter
+// name and type AnalyzeSources recovered for it by parsing the call's
+// resolved source file, e.g. {Name: "ctx", Type: "context.Context",
+// RawValue: Arg{Value: 0xc0001a8000}}.
+type NamedArg struct {
+	Name     string
+	Type     string
+	RawValue Arg
+}
+
+// analyzeSources implements Opts.AnalyzeSources: for each Call whose
+// LocalSrcPath was resolved by updateLocations, it parses that source file
+// once, finds the func declaration or literal whose body contains the
+// call's reported line, and pairs the declared parameter (and, for a
+// method, receiver) names and types with the raw values parseArgs already
+// extracted into c.Args.Values, storing the result as c.NamedArgs.
 //
-// Uses "/" as path separator.
-func rootedIn(root string, parts []string) string {
-	//log.Printf("rootIn(%s, %v)", root, parts)
-	for i := 1; i < len(parts); i++ {
-		suffix := pathJoin(parts[i:]...)
-		if isFile(pathJoin(root, suffix)) {
-			return pathJoin(parts[:i]...)
+// Each source file is parsed at most once per call to analyzeSources, no
+// matter how many frames reference it. A file that can't be read or
+// parsed, a line that doesn't fall inside any function body, or a parsed
+// parameter count that doesn't match the number of raw values (e.g. a
+// variadic call, or an aggregate argument parseArgs didn't fully expand)
+// is left alone: the Call's existing Args are untouched.
+func analyzeSources(goroutines []*Goroutine) {
+	fset := token.NewFileSet()
+	files := map[string]*ast.File{}
+	for _, g := range goroutines {
+		for i := range g.Stack.Calls {
+			analyzeCall(fset, files, &g.Stack.Calls[i])
 		}
 	}
-	return ""
 }
 
-// reModule find the module line in a go.mod file. It works even on CRLF file.
-var reModule = regexp.MustCompile(`(?m)^module\s+([^\n\r]+)\r?$`)
+// analyzeCall is analyzeSources' per-Call step; see there for the overall
+// contract.
+func analyzeCall(fset *token.FileSet, files map[string]*ast.File, c *Call) {
+	if c.LocalSrcPath == "" {
+		return
+	}
+	f, cached := files[c.LocalSrcPath]
+	if !cached {
+		// ParseComments is deliberately not requested: only declarations and
+		// positions are needed, and skipping comments keeps this fast. A
+		// parse failure caches a nil *ast.File, so a bad file is only
+		// attempted once per analyzeSources call, not once per Call pointing
+		// at it.
+		// ParseFile returns a non-nil, best-effort *ast.File alongside an
+		// error for a file with a syntax error; discard it too; walking a
+		// partially-recovered AST risks mislabeling an argument rather than
+		// leaving the Call alone as documented above.
+		if parsed, err := parser.ParseFile(fset, c.LocalSrcPath, nil, 0); err == nil {
+			f = parsed
+		}
+		files[c.LocalSrcPath] = f
+	}
+	if f == nil {
+		return
+	}
+	recv, typ := funcAt(fset, f, c.Line)
+	if typ == nil {
+		return
+	}
+	params := flattenParams(recv, typ.Params)
+	if len(params) != len(c.Args.Values) {
+		return
+	}
+	named := make([]NamedArg, len(params))
+	for i, p := range params {
+		named[i] = NamedArg{Name: p.name, Type: p.typ, RawValue: c.Args.Values[i]}
+	}
+	c.NamedArgs = named
+}
 
-// isGoModule returns the string to the directory containing a go.mod/go.sum
-// files pair, and the go import path it represents, if found.
-func isGoModule(parts []string) (string, string) {
-	for i := len(parts); i > 0; i-- {
-		prefix := pathJoin(parts[:i]...)
-		if isFile(pathJoin(prefix, "go.sum")) {
-			b, err := ioutil.ReadFile(pathJoin(prefix, "go.mod"))
-			if err != nil {
+// funcAt returns the receiver (nil for a func literal) and type of the
+// innermost FuncDecl or FuncLit in f whose body spans line, or a nil typ if
+// none does. "Innermost" matters for a line inside a closure nested in an
+// outer function: the closure's own parameters are the ones in scope there.
+func funcAt(fset *token.FileSet, f *ast.File, line int) (*ast.FieldList, *ast.FuncType) {
+	var bestRecv *ast.FieldList
+	var bestTyp *ast.FuncType
+	bestSize := -1
+	ast.Inspect(f, func(n ast.Node) bool {
+		var recv *ast.FieldList
+		var typ *ast.FuncType
+		var body *ast.BlockStmt
+		switch d := n.(type) {
+		case *ast.FuncDecl:
+			recv, typ, body = d.Recv, d.Type, d.Body
+		case *ast.FuncLit:
+			typ, body = d.Type, d.Body
+		default:
+			return true
+		}
+		if body == nil {
+			return true
+		}
+		start, end := fset.Position(body.Pos()).Line, fset.Position(body.End()).Line
+		if line < start || line > end {
+			return true
+		}
+		// <=, not <: ast.Inspect visits a FuncDecl/FuncLit before the nodes
+		// nested in its body, so when an inner func's body spans the same
+		// line range as its enclosing one (e.g. a one-line immediately
+		// invoked closure), the inner one is visited later and must win the
+		// tie to actually be "innermost".
+		if size := end - start; bestTyp == nil || size <= bestSize {
+			bestRecv, bestTyp, bestSize = recv, typ, size
+		}
+		return true
+	})
+	return bestRecv, bestTyp
+}
+
+// flattenParams expands recv (nil for a func literal) and params into one
+// name/type pair per argument position, in call order, the same order
+// parseArgs extracted the raw values in. A field with multiple names (e.g.
+// "a, b int") expands to one pair per name; an unnamed field (e.g. a
+// func-typed parameter in an interface method signature) keeps an empty
+// name.
+func flattenParams(recv, params *ast.FieldList) []struct{ name, typ string } {
+	var out []struct{ name, typ string }
+	add := func(fields *ast.FieldList) {
+		if fields == nil {
+			return
+		}
+		for _, field := range fields.List {
+			typeStr := types.ExprString(field.Type)
+			if len(field.Names) == 0 {
+				out = append(out, struct{ name, typ string }{typ: typeStr})
 				continue
 			}
-			if match := reModule.FindSubmatch(b); match != nil {
-				return prefix, string(match[1])
+			for _, n := range field.Names {
+				out = append(out, struct{ name, typ string }{name: n.Name, typ: typeStr})
 			}
 		}
 	}
-	return "", ""
+	add(recv)
+	add(params)
+	return out
 }
 
-// findRoots sets member GOROOT, GOPATHs and localGomoduleRoot.
+// indexedRoot identifies what findRoots should do with a file that resolved
+// to a given dirTrie leaf: either it's under the Go standard library, or
+// under one of the local GOPATH entries.
+type indexedRoot struct {
+	// isGOROOT is true when this leaf was discovered under
+	// localgoroot+"/src": findRoots sets RemoteGOROOT for it, rather than
+	// adding an entry to RemoteGOPATHs.
+	isGOROOT bool
+	// gopath is the localgopaths entry this leaf was discovered under (the
+	// $GOPATH entry itself, not its "/src" or "/pkg/mod" subdirectory), used
+	// as the value findRoots records in RemoteGOPATHs.
+	gopath string
+	// walkSuffixLen is len("/src") or len("/pkg/mod"), the subdirectory this
+	// leaf's walk started from below localgoroot/gopath: the matched relative
+	// path only covers what's below that subdirectory, so findRoots must trim
+	// it back off the remote prefix to recover the remote GOROOT/GOPATH
+	// itself.
+	walkSuffixLen int
+	// priority is this leaf's position in buildRootIndex's roots list
+	// (localgoroot first, then each localgopaths entry in order). The walk
+	// visits every root concurrently, so two roots that happen to contain a
+	// file at the same relative path would otherwise race to set a trie
+	// node's leaf; insert keeps the lower-priority (earlier-listed) root
+	// instead, matching the deterministic first-root-wins order the previous
+	// sequential rootedIn scan had.
+	priority int
+}
+
+// dirTrie is a trie over relative file paths discovered by buildRootIndex,
+// letting findRoots resolve a frame's absolute file path against a known
+// root in O(len(parts)) with no further disk I/O, instead of one isFile
+// probe per candidate suffix (the previous O(parts) rootedIn).
 //
-// This causes disk I/O as it checks for file presence.
+// Segments are inserted in reverse (deepest first) order, so that looking
+// up a frame's path, also walked from its last segment backward, finds the
+// longest known suffix in a single descent — the same "try the longest
+// suffix first" behavior rootedIn had, without the repeated stat calls.
+type dirTrie struct {
+	children map[string]*dirTrie
+	// ciChildren maps strings.ToLower(name) to the exact-case key in
+	// children, for longestSuffix's case-insensitive mode. Kept alongside
+	// children (not computed lazily) so a child inserted under one
+	// PathMatching mode is still found under another. When two entries
+	// collide on the same lowercase form (e.g. sibling directories "Foo"
+	// and "foo", rare in practice), the lexicographically smaller exact-case
+	// key wins, chosen deterministically rather than by whichever
+	// concurrent buildRootIndex walker reaches insert first.
+	ciChildren map[string]string
+	leaf       *indexedRoot
+}
+
+func newDirTrie() *dirTrie {
+	return &dirTrie{children: map[string]*dirTrie{}, ciChildren: map[string]string{}}
+}
+
+// insert records that the relative path parts (e.g. ["example.com", "foo",
+// "bar.go"]) was found on disk, rooted as described by root.
+func (t *dirTrie) insert(parts []string, root *indexedRoot) {
+	n := t
+	for i := len(parts) - 1; i >= 0; i-- {
+		key := parts[i]
+		c, ok := n.children[key]
+		if !ok {
+			c = newDirTrie()
+			n.children[key] = c
+		}
+		if lower := strings.ToLower(key); n.ciChildren[lower] == "" || key < n.ciChildren[lower] {
+			n.ciChildren[lower] = key
+		}
+		n = c
+	}
+	if n.leaf == nil || root.priority < n.leaf.priority {
+		n.leaf = root
+	}
+}
+
+// longestSuffix returns the indexedRoot and the number of trailing segments
+// of parts that matched it, for the longest suffix of parts found in the
+// trie. It never consumes parts[0], mirroring rootedIn's historical
+// "i starts at 1" behavior: the first segment alone is never considered a
+// meaningful relative path on its own.
 //
-// Returns the number of missing files.
-func (c *Context) findRoots() int {
-	c.GOPATHs = map[string]string{}
-	missing := 0
-	for _, f := range getFiles(c.Goroutines) {
-		// TODO(maruel): Could a stack dump have mixed cases? I think it's
-		// possible, need to confirm and handle.
-		//log.Printf("  Analyzing %s", f)
+// caseInsensitive selects whether each descent step matches exact-case via
+// children or folded-case via ciChildren: see Context.resolveIndex, which
+// picks it per Context.pathMatching.
+func (t *dirTrie) longestSuffix(parts []string, caseInsensitive bool) (*indexedRoot, int) {
+	n := t
+	var bestRoot *indexedRoot
+	bestLen := 0
+	for i := len(parts) - 1; i > 0; i-- {
+		key := parts[i]
+		if caseInsensitive {
+			key = n.ciChildren[strings.ToLower(parts[i])]
+		}
+		c, ok := n.children[key]
+		if !ok {
+			break
+		}
+		n = c
+		if n.leaf != nil {
+			bestRoot = n.leaf
+			bestLen = len(parts) - i
+		}
+	}
+	return bestRoot, bestLen
+}
+
+// RootIndex is the directory index buildRootIndex produces. It can be
+// reused across ParseDumpWithOpts calls against the same local checkout via
+// Opts.Cache, so a long-running process symbolizing many dumps only walks
+// its GOROOT/GOPATHs once.
+type RootIndex struct {
+	trie *dirTrie
+	// maxWalkDepth is the MaxWalkDepth the index was built with, so a cached
+	// index built with a shallower bound is not reused for a call that needs
+	// to see deeper directories.
+	maxWalkDepth int
+}
+
+// walkRoot is one subtree buildRootIndex walks: every file found under dir
+// is recorded in the index with the given leaf.
+type walkRoot struct {
+	dir  string
+	leaf *indexedRoot
+}
+
+// buildRootIndex walks localgoroot+"/src" and each of localgopaths'
+// "/src" and "/pkg/mod" subtrees exactly once, so that findRoots never has
+// to stat a candidate path per goroutine frame again. Directories are
+// walked by a pool of walkConcurrency goroutines (default runtime.NumCPU())
+// consuming a shared queue, fastwalk-style; os.ReadDir is used instead of
+// filepath.Walk, which stats every entry again after reading the directory.
+// maxWalkDepth, if positive, bounds how many directories deep the walk
+// descends below each root, for use on huge GOPATHs where a full walk is
+// too costly.
+func buildRootIndex(localgoroot string, localgopaths []string, maxWalkDepth, walkConcurrency int) *RootIndex {
+	if walkConcurrency <= 0 {
+		walkConcurrency = runtime.NumCPU()
+	}
+	roots := make([]walkRoot, 0, 1+2*len(localgopaths))
+	roots = append(roots, walkRoot{dir: localgoroot + "/src", leaf: &indexedRoot{isGOROOT: true, walkSuffixLen: len("/src"), priority: 0}})
+	for _, l := range localgopaths {
+		priority := len(roots)
+		roots = append(roots, walkRoot{dir: l + "/src", leaf: &indexedRoot{gopath: l, walkSuffixLen: len("/src"), priority: priority}})
+		roots = append(roots, walkRoot{dir: l + "/pkg/mod", leaf: &indexedRoot{gopath: l, walkSuffixLen: len("/pkg/mod"), priority: priority}})
+	}
+
+	type dirJob struct {
+		dir   string
+		parts []string
+		depth int
+		leaf  *indexedRoot
+	}
+	trie := newDirTrie()
+	var mu sync.Mutex
+	var pending sync.WaitGroup
+	// jobs is buffered so the common case (a subdirectory job fits in the
+	// buffer) doesn't need its own goroutine just to perform the send; only
+	// when the buffer is full, which only happens when every worker is
+	// already busy, do we fall back to a throwaway goroutine so the enqueuing
+	// worker can't deadlock waiting on a receiver that is itself blocked
+	// trying to enqueue.
+	jobs := make(chan dirJob, 4096)
+	enqueue := func(j dirJob) {
+		pending.Add(1)
+		select {
+		case jobs <- j:
+		default:
+			go func() { jobs <- j }()
+		}
+	}
 
-		// First checks skip file I/O.
-		if c.GOROOT != "" && strings.HasPrefix(f, c.GOROOT+"/src/") {
-			// stdlib.
+	var workers sync.WaitGroup
+	for i := 0; i < walkConcurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				entries, err := os.ReadDir(j.dir)
+				if err == nil {
+					for _, e := range entries {
+						parts := append(append([]string{}, j.parts...), e.Name())
+						if e.IsDir() {
+							if maxWalkDepth <= 0 || j.depth < maxWalkDepth {
+								enqueue(dirJob{dir: pathJoin(j.dir, e.Name()), parts: parts, depth: j.depth + 1, leaf: j.leaf})
+							}
+						} else {
+							mu.Lock()
+							trie.insert(parts, j.leaf)
+							mu.Unlock()
+						}
+					}
+				}
+				pending.Done()
+			}
+		}()
+	}
+	for _, r := range roots {
+		enqueue(dirJob{dir: r.dir, leaf: r.leaf})
+	}
+	pending.Wait()
+	close(jobs)
+	workers.Wait()
+	return &RootIndex{trie: trie, maxWalkDepth: maxWalkDepth}
+}
+
+// sameGOPATHs reports whether a and b list the same GOPATH entries in the
+// same order, used by ParseDumpWithOpts to decide whether an Opts.Cache
+// index built for a previous Context is still valid for this one.
+func sameGOPATHs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, v := range a {
+		if v != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reModule find the module line in a go.mod file. It works even on CRLF
+// file. It is only used as a fallback for go.mod files parseGoMod fails to
+// parse, e.g. malformed ones.
+var reModule = regexp.MustCompile(`(?m)^module\s+([^\n\r]+)\r?$`)
+
+// parseGoMod reads the go.mod file at gomod and returns its module path and
+// replace directives, using golang.org/x/mod/modfile. If gomod does not
+// parse, e.g. it is malformed, it falls back to reModule to recover at
+// least the module path.
+func parseGoMod(gomod string) (string, []*modfile.Replace) {
+	b, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return "", nil
+	}
+	f, err := modfile.Parse(gomod, b, nil)
+	if err != nil || f.Module == nil {
+		if match := reModule.FindSubmatch(b); match != nil {
+			return string(match[1]), nil
+		}
+		return "", nil
+	}
+	return f.Module.Mod.Path, f.Replace
+}
+
+// isGoModule returns the directory containing a go.mod, and the go import
+// path it represents, if found. parts is searched from its deepest
+// directory upward.
+//
+// As a side effect, it populates c.LocalGoModules with every other module
+// root it discovers while doing so: local-path "replace" directives in the
+// go.mod it found, and, if that go.mod's directory sits inside a go.work
+// workspace, every module listed in that workspace's "use" stanza. It also
+// sets c.LocalGoWorkspaceRoot if a go.work was found.
+func (c *Context) isGoModule(parts []string) (string, string) {
+	for i := len(parts); i > 0; i-- {
+		prefix := pathJoin(parts[:i]...)
+		gomod := pathJoin(prefix, "go.mod")
+		if !isFile(gomod) {
 			continue
 		}
-		if hasSrcPrefix(f, c.GOPATHs) {
-			// $GOPATH/src or go.mod dependency in $GOPATH/pkg/mod.
+		modPath, replaces := parseGoMod(gomod)
+		if modPath == "" {
 			continue
 		}
+		c.addLocalReplaces(prefix, replaces)
+		c.findGoWorkspace(parts[:i-1])
+		return prefix, modPath
+	}
+	return "", ""
+}
 
-		// At this point, disk will be looked up.
-		parts := splitPath(f)
-		if c.GOROOT == "" {
-			if r := rootedIn(c.localgoroot+"/src", parts); r != "" {
-				c.GOROOT = r[:len(r)-4]
-				//log.Printf("Found GOROOT=%s", c.GOROOT)
-				continue
-			}
+// addLocalReplaces registers the on-disk target of every local-path
+// "replace" directive in replaces (those targeting a relative path rather
+// than a version, e.g. "replace a => ../a", as opposed to "replace a =>
+// b v1.2.3") as a module root relative to prefix.
+func (c *Context) addLocalReplaces(prefix string, replaces []*modfile.Replace) {
+	for _, r := range replaces {
+		if r.New.Version != "" {
+			// Not a local-path replace, e.g. "replace a => b v1.2.3".
+			continue
 		}
-		found := false
-		for _, l := range c.localgopaths {
-			if r := rootedIn(l+"/src", parts); r != "" {
-				//log.Printf("Found GOPATH=%s", r[:len(r)-4])
-				c.GOPATHs[r[:len(r)-4]] = l
-				found = true
-				break
-			}
-			if r := rootedIn(l+"/pkg/mod", parts); r != "" {
-				//log.Printf("Found GOPATH=%s", r[:len(r)-8])
-				c.GOPATHs[r[:len(r)-8]] = l
-				found = true
-				break
-			}
+		dir := path.Clean(pathJoin(prefix, r.New.Path))
+		if isFile(pathJoin(dir, "go.mod")) {
+			c.addLocalGoModule(dir, r.Old.Path)
+		}
+	}
+}
+
+// findGoWorkspace walks parts upward from the primary module looking for a
+// go.work file and, if found, registers every module in its "use" stanza,
+// plus any of its own "replace" directives, into c.LocalGoModules.
+func (c *Context) findGoWorkspace(parts []string) {
+	for i := len(parts); i > 0; i-- {
+		prefix := pathJoin(parts[:i]...)
+		gowork := pathJoin(prefix, "go.work")
+		if !isFile(gowork) {
+			continue
 		}
-		// If the source is not found, it's probably a go module.
-		if !found {
-			if c.localGomoduleRoot == "" && len(parts) > 1 {
-				// Search upward looking for a go.mod/go.sum pair.
-				c.localGomoduleRoot, c.gomodImportPath = isGoModule(parts[:len(parts)-1])
+		b, err := ioutil.ReadFile(gowork)
+		if err != nil {
+			return
+		}
+		wf, err := modfile.ParseWork(gowork, b, nil)
+		if err != nil {
+			return
+		}
+		c.LocalGoWorkspaceRoot = prefix
+		for _, u := range wf.Use {
+			dir := path.Clean(pathJoin(prefix, u.Path))
+			if modPath, _ := parseGoMod(pathJoin(dir, "go.mod")); modPath != "" {
+				c.addLocalGoModule(dir, modPath)
 			}
-			if c.localGomoduleRoot != "" && strings.HasPrefix(f, c.localGomoduleRoot+"/") {
-				continue
+		}
+		c.addLocalReplaces(prefix, wf.Replace)
+		return
+	}
+}
+
+// addLocalGoModule registers an additional module root discovered via a
+// replace directive or a go.work "use" stanza.
+func (c *Context) addLocalGoModule(dir, importPath string) {
+	if c.LocalGoModules == nil {
+		c.LocalGoModules = map[string]string{}
+	}
+	c.LocalGoModules[dir] = importPath
+}
+
+// hasModulePrefix returns true if p sits under any of the module roots in s.
+func hasModulePrefix(p string, s map[string]string) bool {
+	for prefix := range s {
+		if strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveIndex resolves parts against c.index per c.pathMatching:
+// CaseSensitive tries only an exact match, CaseInsensitive only a
+// case-folded one, and Auto tries the exact match first and only falls
+// back to a folded one for a frame the exact pass didn't resolve, so a
+// dump that agrees with the local checkout on case pays no extra cost.
+func (c *Context) resolveIndex(parts []string) (*indexedRoot, int) {
+	if c.pathMatching != CaseInsensitive {
+		if ir, n := c.index.trie.longestSuffix(parts, false); ir != nil {
+			return ir, n
+		}
+		if c.pathMatching == CaseSensitive {
+			return nil, 0
+		}
+	}
+	return c.index.trie.longestSuffix(parts, true)
+}
+
+// driveLetterPOSIX matches a lone-letter POSIX-style stand-in for a
+// Windows drive letter, e.g. the "/c" in "/c/Users/...".
+var driveLetterPOSIX = regexp.MustCompile(`^/[A-Za-z]$`)
+
+// canonicalizeDriveLetter rewrites parts[0] to a single canonical form
+// (e.g. "C:") when it's a Windows drive letter ("C:") or its POSIX-style
+// stand-in ("/c"), so a dump naming the same remote machine under either
+// convention resolves to one RemoteGOROOT/RemoteGOPATHs root instead of
+// two. parts[0] is never consumed by dirTrie.longestSuffix, so this only
+// affects the root string findRoots records, not the matching itself.
+func canonicalizeDriveLetter(parts []string) []string {
+	if len(parts) == 0 {
+		return parts
+	}
+	var letter byte
+	switch first := parts[0]; {
+	case len(first) == 2 && first[1] == ':' && isASCIILetter(first[0]):
+		letter = first[0]
+	case driveLetterPOSIX.MatchString(first):
+		letter = first[1]
+	default:
+		return parts
+	}
+	out := append([]string{}, parts...)
+	out[0] = strings.ToUpper(string(letter)) + ":"
+	return out
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// findRoots sets member RemoteGOROOT, RemoteGOPATHs, localGomoduleRoot and,
+// for multi-module checkouts, LocalGoWorkspaceRoot/LocalGoModules, by
+// resolving every goroutine frame's file path against c.index (see
+// ParseDumpWithOpts, which builds or reuses it before calling findRoots).
+// c.pathMatching (see resolveIndex) and canonicalizeDriveLetter handle a
+// dump produced by a runtime on a different OS than the one resolving it.
+//
+// roots is the set of goroutines to scan for candidate paths. When
+// streaming (see Opts.OnGoroutine), this is only a sample of the goroutines
+// seen so far rather than the full set, since the rest have already been
+// dropped; in practice a single goroutine's set of source files is rarely
+// exhaustive anyway, so a sample of streamDumpRootSampleSize goroutines is
+// normally enough to resolve RemoteGOROOT/RemoteGOPATHs.
+//
+// Returns the number of missing files.
+func (c *Context) findRoots(roots []*Goroutine) int {
+	c.RemoteGOPATHs = map[string]string{}
+	missing := 0
+	for _, f := range getFiles(roots) {
+		//log.Printf("  Analyzing %s", f)
+
+		parts := splitPath(f)
+		if c.pathMatching != CaseSensitive {
+			// Only opted into for cross-OS matching: a plain CaseSensitive
+			// dump might genuinely be rooted at a one-letter directory like
+			// "/c" on a same-OS checkout, which must not be mistaken for a
+			// Windows drive letter.
+			parts = canonicalizeDriveLetter(parts)
+		}
+		if ir, n := c.resolveIndex(parts); ir != nil {
+			r := pathJoin(parts[:len(parts)-n]...)
+			root := r[:len(r)-ir.walkSuffixLen]
+			if ir.isGOROOT {
+				if c.RemoteGOROOT == "" {
+					c.RemoteGOROOT = root
+					//log.Printf("Found RemoteGOROOT=%s", c.RemoteGOROOT)
+				}
+			} else {
+				//log.Printf("Found RemoteGOPATHs=%s", root)
+				c.RemoteGOPATHs[root] = ir.gopath
 			}
+			continue
 		}
-		if !found {
-			// If the source is not found, just too bad.
-			//log.Printf("Failed to find locally: %s", f)
-			missing++
+		// Not found in the index: it's probably a go module.
+		if c.localGomoduleRoot == "" && len(parts) > 1 {
+			// Search upward looking for a go.mod.
+			c.localGomoduleRoot, c.gomodImportPath = c.isGoModule(parts[:len(parts)-1])
 		}
+		if c.localGomoduleRoot != "" && strings.HasPrefix(f, c.localGomoduleRoot+"/") {
+			continue
+		}
+		if hasModulePrefix(f, c.LocalGoModules) {
+			// A go.work "use" entry or a local-path "replace" target.
+			continue
+		}
+		// If the source is not found, just too bad.
+		//log.Printf("Failed to find locally: %s", f)
+		missing++
 	}
 	return missing
 }
@@ -951,4 +2050,4 @@ func trimLeftSpace(s []byte) []byte {
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
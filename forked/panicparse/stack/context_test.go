@@ -0,0 +1,670 @@
+// Copyright 2018 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+func TestScanRaceStackUnavailable(t *testing.T) {
+	s := scanningState{}
+	lines := []string{
+		"==================\n",
+		"WARNING: DATA RACE\n",
+		"Read at 0x00c0000e4030 by goroutine 7:\n",
+		"    [failed to restore the stack]\n",
+		"\n",
+		"Goroutine 7 (running) created at:\n",
+		"  main.main()\n",
+		"      /tmp/main.go:10 +0x47\n",
+		"==================\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if len(s.goroutines) == 0 || !s.goroutines[0].StackUnavailable {
+		t.Fatal("expected goroutine 0 to have StackUnavailable set")
+	}
+}
+
+func TestScanRaceGlobal(t *testing.T) {
+	s := scanningState{}
+	lines := []string{
+		"==================\n",
+		"WARNING: DATA RACE\n",
+		"Read at 0x00c0000e4030 by goroutine 7:\n",
+		"  Global var main.count of size 8 at 0x000001234567 declared at /tmp/main.go:12\n",
+		"\n",
+		"Goroutine 7 (running) created at:\n",
+		"  main.main()\n",
+		"      /tmp/main.go:10 +0x47\n",
+		"==================\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if len(s.goroutines) == 0 || s.goroutines[0].RaceGlobal == nil {
+		t.Fatal("expected goroutine 0 to have RaceGlobal set")
+	}
+	g := s.goroutines[0].RaceGlobal
+	if g.Name != "main.count" || g.Size != 8 || g.DeclFile != "/tmp/main.go" || g.DeclLine != 12 {
+		t.Fatalf("unexpected RaceGlobal: %#v", g)
+	}
+}
+
+func TestScanRaceMixedReport(t *testing.T) {
+	// A race report with one operation whose stack is a normal read/write
+	// stack, and a second operation hitting a global, to exercise both code
+	// paths falling through the same state machine in one report.
+	s := scanningState{}
+	lines := []string{
+		"==================\n",
+		"WARNING: DATA RACE\n",
+		"Write at 0x00c0000e4030 by goroutine 7:\n",
+		"  main.inc()\n",
+		"      /tmp/main.go:20 +0x44\n",
+		"\n",
+		"Previous read at 0x00c0000e4030 by goroutine 8:\n",
+		"  Global var main.count of size 8 at 0x000001234567 declared at /tmp/main.go:12\n",
+		"\n",
+		"Goroutine 7 (running) created at:\n",
+		"  main.main()\n",
+		"      /tmp/main.go:10 +0x47\n",
+		"==================\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if len(s.goroutines) != 2 {
+		t.Fatalf("expected 2 race operations, got %d", len(s.goroutines))
+	}
+	if s.goroutines[0].RaceGlobal != nil {
+		t.Fatal("first operation should be a normal stack, not a global")
+	}
+	if s.goroutines[1].RaceGlobal == nil || s.goroutines[1].RaceGlobal.Name != "main.count" {
+		t.Fatalf("second operation should be the global, got: %#v", s.goroutines[1].RaceGlobal)
+	}
+}
+
+// TestParseArgsMatrix covers the argument-printing dialects from each
+// supported Go release: flat hex scalars (Go 1.16 and earlier), "{...}"
+// aggregate tuples (Go 1.17+), and the "?" scrubbed-argument placeholder
+// plus "@0x..." moved-to-heap suffix (Go 1.21+). Each case round-trips
+// through Args.String() to confirm parsing didn't lose any information.
+func TestParseArgsMatrix(t *testing.T) {
+	testCases := []string{
+		// Go 1.16 and earlier: flat hex scalars, maybe elided.
+		"",
+		"0xc000194000",
+		"0xc000194000, 0x1, 0x2",
+		"0xc000194000, ...",
+		// Go 1.17+: aggregate tuples, possibly nested.
+		"{0xc0000140a0, 0x3, 0x3}, 0x1",
+		"{0xc0000140a0, 0x3, 0x3}, {0x1, {0x2, 0x3}}",
+		"{0xc0000140a0, ...}",
+		// Go 1.21+: scrubbed args and moved-to-heap addresses.
+		"?, 0x1",
+		"0xc000194000@0xc000195000, 0x1",
+	}
+	for _, raw := range testCases {
+		args, err := parseArgs([]byte(raw))
+		if err != nil {
+			t.Errorf("parseArgs(%q): %s", raw, err)
+			continue
+		}
+		if got := args.String(); got != raw {
+			t.Errorf("parseArgs(%q).String() = %q, want %q", raw, got, raw)
+		}
+	}
+}
+
+func TestParseArgsUnterminatedAggregate(t *testing.T) {
+	if _, err := parseArgs([]byte("{0x1, 0x2")); err == nil {
+		t.Fatal("expected an error for an unterminated aggregate argument")
+	}
+}
+
+func TestHasModulePrefix(t *testing.T) {
+	modules := map[string]string{
+		"/home/user/go/src/example.com/sibling": "example.com/sibling",
+	}
+	if !hasModulePrefix("/home/user/go/src/example.com/sibling/pkg/file.go", modules) {
+		t.Error("expected a file under a registered module root to match")
+	}
+	if hasModulePrefix("/home/user/go/src/example.com/other/file.go", modules) {
+		t.Error("did not expect a file outside any registered module root to match")
+	}
+	if hasModulePrefix("/home/user/go/src/example.com/sibling", modules) {
+		t.Error("did not expect the module root itself, with no trailing slash, to match")
+	}
+}
+
+func TestAddLocalReplacesNormalizesRelativePath(t *testing.T) {
+	root := t.TempDir()
+	proj := filepath.Join(root, "proj")
+	sibling := filepath.Join(root, "sibling")
+	for _, dir := range []string{proj, sibling} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Context{}
+	replaces := []*modfile.Replace{
+		{Old: module.Version{Path: "example.com/sibling"}, New: module.Version{Path: "../sibling"}},
+	}
+	c.addLocalReplaces(proj, replaces)
+
+	// The replace target is recorded normalized, e.g. ".../sibling" rather
+	// than ".../proj/../sibling", so that a traceback's already-normalized
+	// source paths are recognized by hasModulePrefix.
+	if _, ok := c.LocalGoModules[sibling]; !ok {
+		t.Fatalf("LocalGoModules = %v, want a normalized entry for %s", c.LocalGoModules, sibling)
+	}
+	if !hasModulePrefix(filepath.Join(sibling, "pkg", "file.go"), c.LocalGoModules) {
+		t.Error("expected a file under the replace target to match after normalization")
+	}
+}
+
+func TestFindRootsResolvesViaGoWorkWorkspace(t *testing.T) {
+	root := t.TempDir()
+	ws := filepath.Join(root, "ws")
+	primary := filepath.Join(ws, "primary")
+	sibling := filepath.Join(ws, "sibling")
+	for _, dir := range []string{primary, sibling} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(primary, "go.mod"), []byte("module example.com/primary\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sibling, "go.mod"), []byte("module example.com/sibling\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	gowork := "go 1.21\n\nuse ./primary\nuse ./sibling\n"
+	if err := ioutil.WriteFile(filepath.Join(ws, "go.work"), []byte(gowork), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	primaryFile := filepath.Join(primary, "main.go")
+	siblingFile := filepath.Join(sibling, "lib.go")
+	for _, f := range []string{primaryFile, siblingFile} {
+		if err := ioutil.WriteFile(f, []byte("package x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One goroutine calling into the sibling module, which lives outside
+	// primary's own tree and is only reachable through go.work's "use"
+	// stanza.
+	s := scanningState{}
+	lines := []string{
+		"goroutine 1 [running]:\n",
+		"example.com/sibling.Do()\n",
+		"\t" + siblingFile + ":1 +0x1\n",
+		"example.com/primary.main()\n",
+		"\t" + primaryFile + ":1 +0x2\n",
+		"\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if len(s.goroutines) == 0 {
+		t.Fatal("expected a goroutine")
+	}
+
+	// No GOROOT/GOPATH involved: both frames are resolved as go.work modules.
+	c := &Context{localgoroot: filepath.Join(root, "goroot")}
+	c.index = buildRootIndex(c.localgoroot, nil, 0, 2)
+	if missing := c.findRoots(s.goroutines); missing != 0 {
+		t.Errorf("findRoots() missing = %d, want 0", missing)
+	}
+	if c.LocalGoWorkspaceRoot != ws {
+		t.Errorf("LocalGoWorkspaceRoot = %q, want %q", c.LocalGoWorkspaceRoot, ws)
+	}
+	if c.localGomoduleRoot != primary {
+		t.Errorf("localGomoduleRoot = %q, want %q", c.localGomoduleRoot, primary)
+	}
+	if !hasModulePrefix(siblingFile, c.LocalGoModules) {
+		t.Errorf("LocalGoModules = %v, want an entry covering %s", c.LocalGoModules, siblingFile)
+	}
+}
+
+func TestFindRootsResolvesViaIndex(t *testing.T) {
+	root := t.TempDir()
+	goroot := filepath.Join(root, "goroot")
+	gopath := filepath.Join(root, "gopath")
+	srcFile := filepath.Join(gopath, "src", "example.com", "foo", "bar.go")
+	if err := os.MkdirAll(filepath.Dir(srcFile), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(srcFile, []byte("package foo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := scanningState{}
+	lines := []string{
+		"goroutine 1 [running]:\n",
+		"example.com/foo.Bar()\n",
+		"\t" + srcFile + ":1 +0x1\n",
+		"\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if len(s.goroutines) == 0 {
+		t.Fatal("expected a goroutine")
+	}
+
+	c := &Context{localgoroot: goroot, localgopaths: []string{gopath}}
+	c.index = buildRootIndex(c.localgoroot, c.localgopaths, 0, 2)
+	if missing := c.findRoots(s.goroutines); missing != 0 {
+		t.Errorf("findRoots() missing = %d, want 0", missing)
+	}
+	if c.RemoteGOPATHs[gopath] != gopath {
+		t.Errorf("RemoteGOPATHs = %v, want an entry for %s -> %s", c.RemoteGOPATHs, gopath, gopath)
+	}
+}
+
+// findRootsWithMismatchedCase is shared by the PathMatching tests: it
+// writes example.com/foo/bar.go under a local gopath, then resolves a
+// goroutine whose frame names that same file with its relative portion
+// (everything below "src") re-cased as Example.COM/Foo/Bar.go, so the
+// gopath root itself still matches byte-for-byte and only the case-folding
+// behavior under test is exercised.
+func findRootsWithMismatchedCase(t *testing.T, pathMatching PathMatching) (missing int, c *Context, gopath string) {
+	t.Helper()
+	root := t.TempDir()
+	goroot := filepath.Join(root, "goroot")
+	gopath = filepath.Join(root, "gopath")
+	srcFile := filepath.Join(gopath, "src", "example.com", "foo", "bar.go")
+	if err := os.MkdirAll(filepath.Dir(srcFile), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(srcFile, []byte("package foo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dumpFile := filepath.Join(gopath, "src", "Example.COM", "Foo", "Bar.go")
+
+	s := scanningState{}
+	lines := []string{
+		"goroutine 1 [running]:\n",
+		"example.com/foo.Bar()\n",
+		"\t" + dumpFile + ":1 +0x1\n",
+		"\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if len(s.goroutines) == 0 {
+		t.Fatal("expected a goroutine")
+	}
+
+	c = &Context{localgoroot: goroot, localgopaths: []string{gopath}, pathMatching: pathMatching}
+	c.index = buildRootIndex(c.localgoroot, c.localgopaths, 0, 2)
+	return c.findRoots(s.goroutines), c, gopath
+}
+
+func TestFindRootsCaseSensitiveDefaultMissesCaseMismatch(t *testing.T) {
+	if missing, _, _ := findRootsWithMismatchedCase(t, CaseSensitive); missing != 1 {
+		t.Errorf("findRoots() missing = %d, want 1 (CaseSensitive is the zero value and should not match)", missing)
+	}
+}
+
+func TestFindRootsCaseInsensitiveMatchesMixedCaseDump(t *testing.T) {
+	missing, c, gopath := findRootsWithMismatchedCase(t, CaseInsensitive)
+	if missing != 0 {
+		t.Fatalf("findRoots() missing = %d, want 0", missing)
+	}
+	if c.RemoteGOPATHs[gopath] != gopath {
+		t.Errorf("RemoteGOPATHs = %v, want an entry for %s -> %s", c.RemoteGOPATHs, gopath, gopath)
+	}
+}
+
+func TestFindRootsAutoFallsBackToCaseInsensitive(t *testing.T) {
+	if missing, _, _ := findRootsWithMismatchedCase(t, Auto); missing != 0 {
+		t.Errorf("findRoots() missing = %d, want 0 (Auto should fall back to case-insensitive matching)", missing)
+	}
+}
+
+func TestFindRootsResolvesWindowsDumpAgainstLinuxCheckout(t *testing.T) {
+	root := t.TempDir()
+	goroot := filepath.Join(root, "goroot")
+	gopath := filepath.Join(root, "gopath")
+	srcFile := filepath.Join(gopath, "src", "example.com", "foo", "bar.go")
+	if err := os.MkdirAll(filepath.Dir(srcFile), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(srcFile, []byte("package foo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A Windows GOTRACEBACK names its own drive-lettered GOPATH, with its own
+	// casing convention, entirely unrelated to the Linux checkout's path:
+	// only the relative example.com/foo/bar.go suffix is shared.
+	s := scanningState{}
+	lines := []string{
+		"goroutine 1 [running]:\n",
+		"example.com/foo.Bar()\n",
+		"\tC:/Users/dev/go/src/Example.COM/Foo/Bar.go:1 +0x1\n",
+		"\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if len(s.goroutines) == 0 {
+		t.Fatal("expected a goroutine")
+	}
+
+	c := &Context{localgoroot: goroot, localgopaths: []string{gopath}, pathMatching: Auto}
+	c.index = buildRootIndex(c.localgoroot, c.localgopaths, 0, 2)
+	if missing := c.findRoots(s.goroutines); missing != 0 {
+		t.Errorf("findRoots() missing = %d, want 0", missing)
+	}
+	if want := "C:/Users/dev/go"; c.RemoteGOPATHs[want] != gopath {
+		t.Errorf("RemoteGOPATHs = %v, want an entry for %s -> %s", c.RemoteGOPATHs, want, gopath)
+	}
+}
+
+func TestCanonicalizeDriveLetter(t *testing.T) {
+	cases := []struct {
+		in   []string
+		want []string
+	}{
+		{[]string{"c:", "Users", "foo"}, []string{"C:", "Users", "foo"}},
+		{[]string{"/c", "Users", "foo"}, []string{"C:", "Users", "foo"}},
+		{[]string{"/home", "foo"}, []string{"/home", "foo"}},
+		{nil, nil},
+	}
+	for _, tc := range cases {
+		if got := canonicalizeDriveLetter(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("canonicalizeDriveLetter(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestScanStreamingDropsCompletedGoroutines(t *testing.T) {
+	var seen []int
+	s := scanningState{
+		onGoroutine: func(g *Goroutine) error {
+			seen = append(seen, g.ID)
+			return nil
+		},
+	}
+	lines := []string{
+		"goroutine 1 [running]:\n",
+		"main.main()\n",
+		"\t/tmp/main.go:10 +0x47\n",
+		"\n",
+		"goroutine 2 [chan receive]:\n",
+		"main.worker()\n",
+		"\t/tmp/main.go:20 +0x20\n",
+		"\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if want := []int{1, 2}; len(seen) != len(want) || seen[0] != want[0] || seen[1] != want[1] {
+		t.Fatalf("onGoroutine called with %v, want %v", seen, want)
+	}
+	if len(s.goroutines) != 0 {
+		t.Fatalf("expected completed goroutines to be dropped, got %d left", len(s.goroutines))
+	}
+	if s.goroutineCount != 2 {
+		t.Fatalf("goroutineCount = %d, want 2", s.goroutineCount)
+	}
+}
+
+func TestScanStreamingCompletesRaceBlockAsOne(t *testing.T) {
+	var seen []int
+	s := scanningState{
+		onGoroutine: func(g *Goroutine) error {
+			seen = append(seen, g.ID)
+			return nil
+		},
+	}
+	lines := []string{
+		"==================\n",
+		"WARNING: DATA RACE\n",
+		"Write at 0x00c0000e4030 by goroutine 7:\n",
+		"  main.inc()\n",
+		"      /tmp/main.go:20 +0x44\n",
+		"\n",
+		"Goroutine 7 (running) created at:\n",
+		"  main.main()\n",
+		"      /tmp/main.go:10 +0x47\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+		if len(seen) != 0 {
+			t.Fatalf("onGoroutine fired before the race report's closing footer, at line %q", line)
+		}
+	}
+	if _, err := s.scan([]byte("==================\n")); err != nil {
+		t.Fatalf("scan(footer): %s", err)
+	}
+	if want := []int{7}; len(seen) != len(want) || seen[0] != want[0] {
+		t.Fatalf("onGoroutine called with %v, want %v", seen, want)
+	}
+	if len(s.goroutines) != 0 {
+		t.Fatalf("expected the race block to be dropped after its footer, got %d left", len(s.goroutines))
+	}
+}
+
+func TestFlushMidRaceReportCompletesIt(t *testing.T) {
+	// A dump that ends abruptly partway through a race report, before its
+	// closing footer: flush must still complete and drop it like a normal
+	// footer would, or it leaks into Context.Goroutines in streaming mode.
+	var seen []int
+	s := scanningState{
+		onGoroutine: func(g *Goroutine) error {
+			seen = append(seen, g.ID)
+			return nil
+		},
+	}
+	lines := []string{
+		"==================\n",
+		"WARNING: DATA RACE\n",
+		"Write at 0x00c0000e4030 by goroutine 7:\n",
+		"  main.inc()\n",
+		"      /tmp/main.go:20 +0x44\n",
+		"\n",
+		"Goroutine 7 (running) created at:\n",
+		"  main.main()\n",
+		"      /tmp/main.go:10 +0x47\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if err := s.flush(); err != nil {
+		t.Fatalf("flush(): %s", err)
+	}
+	if want := []int{7}; len(seen) != len(want) || seen[0] != want[0] {
+		t.Fatalf("onGoroutine called with %v, want %v", seen, want)
+	}
+	if len(s.goroutines) != 0 {
+		t.Fatalf("expected flush to drop the race block, got %d left", len(s.goroutines))
+	}
+}
+
+func TestScanCgoSignal(t *testing.T) {
+	s := scanningState{}
+	lines := []string{
+		"signal arrived during cgo execution\n",
+		"[signal SIGSEGV: segmentation violation code=0x1 addr=0x18 pc=0x47e5ce]\n",
+		"goroutine 1 [running]:\n",
+		"runtime.cgocall(0x47f420, 0xc000045f38, 0x0)\n",
+		"\t/usr/local/go/src/runtime/cgocall.go:133 +0x5b fp=0xc000045f10 sp=0xc000045ed8 pc=0x4022fb\n",
+		"main._Cfunc_boom()\n",
+		"\t??:0 +0x29\n",
+		"main.crash.func1()\n",
+		"\t/tmp/main.go:10 +0x17\n",
+		"\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if len(s.goroutines) == 0 {
+		t.Fatal("expected a goroutine")
+	}
+	g := s.goroutines[0]
+	if g.SignalInfo == nil {
+		t.Fatal("expected SignalInfo to be set")
+	}
+	if g.SignalInfo.Signal != "SIGSEGV" || g.SignalInfo.Description != "segmentation violation" ||
+		g.SignalInfo.Code != 1 || g.SignalInfo.Addr != 0x18 || g.SignalInfo.PC != 0x47e5ce {
+		t.Fatalf("unexpected SignalInfo: %#v", g.SignalInfo)
+	}
+	if len(g.Stack.Calls) != 3 {
+		t.Fatalf("expected 3 calls, got %d: %#v", len(g.Stack.Calls), g.Stack.Calls)
+	}
+	cgocall := g.Stack.Calls[0]
+	if cgocall.IsCgo {
+		t.Fatal("runtime.cgocall's own frame is Go, not cgo")
+	}
+	if cgocall.FP != 0xc000045f10 || cgocall.SP != 0xc000045ed8 || cgocall.PC != 0x4022fb {
+		t.Fatalf("fp/sp/pc not parsed: %#v", cgocall)
+	}
+	if !g.Stack.Calls[1].IsCgo {
+		t.Fatal("expected the \"??:0\" frame to be tagged IsCgo")
+	}
+}
+
+func TestScanCgoFrameWithKnownSource(t *testing.T) {
+	// Not every cgo frame is unsymbolized: one generated from a .c file (e.g.
+	// cgo's own glue code) should still be tagged IsCgo.
+	s := scanningState{}
+	lines := []string{
+		"goroutine 1 [running]:\n",
+		"main._Cfunc_boom()\n",
+		"\t_cgo_gotypes.c:45 +0x29\n",
+		"\n",
+	}
+	for _, line := range lines {
+		if _, err := s.scan([]byte(line)); err != nil {
+			t.Fatalf("scan(%q): %s", line, err)
+		}
+	}
+	if len(s.goroutines) == 0 || len(s.goroutines[0].Stack.Calls) == 0 {
+		t.Fatal("expected a goroutine with a call")
+	}
+	if !s.goroutines[0].Stack.Calls[0].IsCgo {
+		t.Fatal("expected a .c source frame to be tagged IsCgo")
+	}
+}
+
+func TestScanSignalArrivedFallsBackOnMismatch(t *testing.T) {
+	// Mirrors gotRaceHeader1's behavior: if what follows the prolog isn't
+	// actually a "[signal ...]" line, don't abort the whole dump, just treat
+	// it as junk and keep scanning.
+	s := scanningState{}
+	if _, err := s.scan([]byte("signal arrived during cgo execution\n")); err != nil {
+		t.Fatalf("scan(prolog): %s", err)
+	}
+	out, err := s.scan([]byte("not a signal line\n"))
+	if err != nil {
+		t.Fatalf("scan(mismatch): %s", err)
+	}
+	if string(out) != "not a signal line\n" {
+		t.Fatalf("expected the mismatched line to flow through to out, got %q", out)
+	}
+	if s.state != normal {
+		t.Fatalf("expected state to fall back to normal, got %v", s.state)
+	}
+}
+
+func TestAnalyzeSourcesNamesArguments(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "worker.go")
+	const body = `package worker
+
+func doWork(ctx int, n int) {
+	_ = ctx
+	_ = n
+}
+`
+	if err := ioutil.WriteFile(src, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &Goroutine{Stack: Stack{Calls: []Call{{
+		LocalSrcPath: src,
+		Line:         4, // the "_ = ctx" line, inside doWork's body.
+		Args:         Args{Values: []Arg{{Value: 0xc0001a8000}, {Value: 42}}},
+	}}}}
+	analyzeSources([]*Goroutine{g})
+	got := g.Stack.Calls[0].NamedArgs
+	want := []NamedArg{
+		{Name: "ctx", Type: "int", RawValue: Arg{Value: 0xc0001a8000}},
+		{Name: "n", Type: "int", RawValue: Arg{Value: 42}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("NamedArgs = %#v, want %#v", got, want)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("NamedArgs[%d] = %#v, want %#v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestAnalyzeSourcesLeavesCallAloneOnMismatch(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "worker.go")
+	const body = `package worker
+
+func doWork(ctx int, n int) {
+	_ = ctx
+}
+`
+	if err := ioutil.WriteFile(src, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one raw value for a two-parameter function: the argument count
+	// doesn't match, so the Call must be left untouched rather than
+	// mislabeling a value under the wrong parameter name.
+	g := &Goroutine{Stack: Stack{Calls: []Call{{
+		LocalSrcPath: src,
+		Line:         4,
+		Args:         Args{Values: []Arg{{Value: 1}}},
+	}}}}
+	analyzeSources([]*Goroutine{g})
+	if g.Stack.Calls[0].NamedArgs != nil {
+		t.Fatalf("NamedArgs = %#v, want nil on an argument-count mismatch", g.Stack.Calls[0].NamedArgs)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package stack
+
+import "strings"
+
+// Goroutine represents the state of one goroutine, as printed by
+// runtime.Stack() or a runtime crash dump.
+type Goroutine struct {
+	// Signature is the goroutine's state as found in its traceback header,
+	// e.g. "running" or "chan receive, 5 minutes".
+	Signature
+
+	// ID is the goroutine id, as printed right after "goroutine" in the
+	// header line.
+	ID int
+	// First is true for the first goroutine printed in the dump; it is the
+	// one that was running when the dump was triggered.
+	First bool
+
+	// RaceWrite and RaceAddr are set when this goroutine's header came from
+	// a "DATA RACE" report instead of a regular traceback: RaceWrite is true
+	// if this goroutine performed the conflicting write (as opposed to a
+	// read), and RaceAddr is the address that was accessed.
+	RaceWrite bool
+	RaceAddr  uint64
+	// RaceGlobal is set, alongside RaceAddr, when the race detector resolved
+	// the address to a named global variable rather than a bare address.
+	RaceGlobal *RaceGlobal
+
+	// StackUnavailable is true when the race detector reported this
+	// goroutine's stack as "[failed to restore the stack]" rather than a
+	// regular list of calls; Stack is then left empty.
+	StackUnavailable bool
+
+	// SignalInfo is set when this goroutine's header was immediately
+	// preceded by a cgo "signal arrived during cgo execution" crash prolog,
+	// e.g. under GOTRACEBACK=crash.
+	SignalInfo *SignalInfo
+
+	// CreatedBy is the stack of the goroutine that started this one, or the
+	// zero Stack if this is the first goroutine or its creator wasn't
+	// printed.
+	CreatedBy Stack
+	// Stack is this goroutine's own call stack, innermost frame first.
+	Stack Stack
+}
+
+// updateLocations translates every call in g's CreatedBy and Stack from the
+// remote path it was printed with to the corresponding path on the host
+// running this code, so the result can be used to open and analyze the
+// source. See ParseDumpWithOpts and Context.findRoots, which compute the
+// remote/local root pairs passed in here.
+func (g *Goroutine) updateLocations(remoteGOROOT, localgoroot, localGomoduleRoot, gomodImportPath string, remoteGOPATHs map[string]string) {
+	g.CreatedBy.updateLocations(remoteGOROOT, localgoroot, localGomoduleRoot, gomodImportPath, remoteGOPATHs)
+	g.Stack.updateLocations(remoteGOROOT, localgoroot, localGomoduleRoot, gomodImportPath, remoteGOPATHs)
+}
+
+// Signature is the subset of a Goroutine that two goroutines must have in
+// common to be considered identical by Aggregate.
+type Signature struct {
+	// State is the goroutine state, e.g. "running" or "chan receive".
+	State string
+	// SleepMin and SleepMax are the sleep duration in minutes, as reported
+	// in the state, e.g. "chan receive, 5 minutes". They are equal unless the
+	// traceback reported a range.
+	SleepMin int
+	SleepMax int
+	// Locked is true if the goroutine is locked to its OS thread, e.g.
+	// "chan receive, locked to thread".
+	Locked bool
+}
+
+// Stack is a sequence of calls, innermost frame first.
+type Stack struct {
+	// Calls is the list of calls that forms this stack.
+	Calls []Call
+	// Elided is true when the runtime truncated this stack with "...
+	// additional frames elided...".
+	Elided bool
+}
+
+// updateLocations translates every call in s; see Goroutine.updateLocations.
+func (s *Stack) updateLocations(remoteGOROOT, localgoroot, localGomoduleRoot, gomodImportPath string, remoteGOPATHs map[string]string) {
+	for i := range s.Calls {
+		s.Calls[i].updateLocation(remoteGOROOT, localgoroot, localGomoduleRoot, gomodImportPath, remoteGOPATHs)
+	}
+}
+
+// Call is one function call in a stack trace.
+type Call struct {
+	// SrcPath is the source file path as printed in the dump, e.g.
+	// "/home/user/go/src/foo/bar.go".
+	SrcPath string
+	// Line is the line number within SrcPath.
+	Line int
+	// Func is the function or method being called.
+	Func Func
+	// Args is the call's argument list.
+	Args Args
+
+	// LocalSrcPath is SrcPath translated to the local host, filled in by
+	// updateLocations. Empty if ParseDump/ParseDumpWithOpts was called with
+	// guesspaths/Opts.GuessPaths false, or if the path couldn't be resolved
+	// locally.
+	LocalSrcPath string
+	// IsStdlib is true if SrcPath is under GOROOT, filled in by
+	// updateLocations.
+	IsStdlib bool
+
+	// IsCgo is true if this frame is a C frame reached through cgo: its
+	// SrcPath is either cgoUnknownSrcPath ("??") or ends in ".c".
+	IsCgo bool
+	// FP, SP and PC are the frame, stack and program counter pointers
+	// printed at the end of the file:line, when present (e.g. under
+	// GOTRACEBACK=system or for a cgo frame).
+	FP, SP, PC uint64
+
+	// NamedArgs is filled in by analyzeSources (see Opts.AnalyzeSources):
+	// each entry pairs an Args.Values element with the parameter name and
+	// type its LocalSrcPath declares, when the two line up unambiguously.
+	NamedArgs []NamedArg
+}
+
+// init resets c to the frame described by a freshly parsed source line,
+// discarding whatever LocalSrcPath/IsStdlib a prior updateLocations pass
+// left on a reused Call.
+func (c *Call) init(srcPath string, line int) {
+	c.SrcPath = srcPath
+	c.Line = line
+	c.LocalSrcPath = ""
+	c.IsStdlib = false
+}
+
+// updateLocation translates c's SrcPath; see Goroutine.updateLocations.
+func (c *Call) updateLocation(remoteGOROOT, localgoroot, localGomoduleRoot, gomodImportPath string, remoteGOPATHs map[string]string) {
+	switch {
+	case remoteGOROOT != "" && strings.HasPrefix(c.SrcPath, remoteGOROOT+"/"):
+		c.LocalSrcPath = localgoroot + c.SrcPath[len(remoteGOROOT):]
+		c.IsStdlib = true
+	case localGomoduleRoot != "" && gomodImportPath != "" && strings.HasPrefix(c.SrcPath, gomodImportPath+"/"):
+		c.LocalSrcPath = localGomoduleRoot + c.SrcPath[len(gomodImportPath):]
+	default:
+		for remote, local := range remoteGOPATHs {
+			if strings.HasPrefix(c.SrcPath, remote+"/") {
+				c.LocalSrcPath = local + c.SrcPath[len(remote):]
+				break
+			}
+		}
+	}
+}
+
+// Func is the fully qualified function or method name attached to a Call,
+// e.g. "main.(*Foo).Bar" or "main.main".
+type Func struct {
+	// Complete is the symbol exactly as printed in the trace.
+	Complete string
+}
+
+// Init parses s, the raw symbol text preceding a call's argument list.
+func (f *Func) Init(s string) error {
+	f.Complete = s
+	return nil
+}
+
+// String renders f back to the text it was parsed from.
+func (f Func) String() string {
+	return f.Complete
+}
+
+// Args and Arg are defined in context.go.
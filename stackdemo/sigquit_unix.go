@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// raiseSigquit sends SIGQUIT to this process, invoking the runtime's
+// default all-goroutine crash traceback unless something has registered a
+// signal.Notify handler for it.
+func raiseSigquit() {
+	if err := syscall.Kill(os.Getpid(), syscall.SIGQUIT); err != nil {
+		panic(err)
+	}
+}
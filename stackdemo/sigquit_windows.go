@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+// raiseSigquit panics: Windows has no SIGQUIT equivalent, so -crashDumpSigquit
+// isn't supported on this platform.
+func raiseSigquit() {
+	panic("-crashDumpSigquit is not supported on windows: there is no SIGQUIT equivalent")
+}
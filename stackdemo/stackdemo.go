@@ -8,7 +8,9 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"runtime"
+	"runtime/debug"
 	"runtime/pprof"
+	"runtime/trace"
 	"sync"
 	"time"
 )
@@ -21,13 +23,22 @@ func main() {
 	oomTouch := flag.Bool("oomTouch", true, "If true, will touch each page of memory that it allocates")
 	writeStacks := flag.String("writeStacks", "", "Path to write stacks using pprof.Profile.WriteTo")
 	writeStacksDebug := flag.Int("writeStacksDebug", 2, "pprof.Profile.WriteTo; 0=binary; 1=comments; 2=text")
+	writeTrace := flag.String("writeTrace", "", "Path to write a runtime/trace execution trace covering traceDuration; ''=disabled; see stopTraceOnce")
+	traceDuration := flag.Duration("traceDuration", 5*time.Second, "How long to capture the runtime trace after starting, if -writeTrace is set")
 	exit := flag.Bool("exit", false, "true: Exit immediately at end; false: block forever")
 	panicAtEnd := flag.Bool("panic", false, "true: Panic at end of main()")
 	oomChunkSizeMiB := flag.Int("oomChunkSizeMiB", 1, "Size of allocations when trying to run out of memory (MiB)")
 	runningGoroutines := flag.Int("runningGoroutines", 0, "Goroutines that will be running; causes them to not be written in stacks")
+	syscallGoroutines := flag.Int("syscallGoroutines", 0, "Goroutines blocked reading from a pipe that's never written to, split between blockInRawSyscall and blockInIOWait")
+	lockedOSThreads := flag.Int("lockedOSThreads", 0, "Goroutines blocked forever with a locked OS thread; see e2")
+	exitingThreads := flag.Int("exitingThreads", 0, "Concurrency of short-lived locked-OS-thread goroutines continuously spawned and exited; see runExitingThreads")
+	crashDump := flag.String("crashDump", "", "Path to write a SIGQUIT-style full traceback; ''=disabled; see fullGoroutineStack")
+	crashDumpSigquit := flag.Bool("crashDumpSigquit", false, "If true, after writing -crashDump, also raise SIGQUIT against this process")
+	goTraceback := flag.String("goTraceback", "", "If set to 'single', 'all', 'system' or 'crash', calls debug.SetTraceback with that level; ''=leave GOTRACEBACK as configured in the environment")
+	deadlock := flag.String("deadlock", "", "If set to 'simple', 'locked' or 'chanrecv', blocks every goroutine so the runtime's own deadlock detector fires; ''=disabled; see blockDeadlock")
 	flag.Parse()
 
-	if *pprofAddr != "" {
+	if *pprofAddr != "" && *deadlock == "" {
 		log.Printf("listening on addr http://%s ...", *pprofAddr)
 		go func() {
 			err := http.ListenAndServe(*pprofAddr, nil)
@@ -37,6 +48,28 @@ func main() {
 		}()
 	}
 
+	stopTrace := func() {}
+	if *writeTrace != "" && *deadlock == "" {
+		// A pending traceDuration timer, like the -pprofAddr listener above,
+		// keeps the runtime from declaring a deadlock, so this is skipped
+		// together with -pprofAddr when -deadlock is set.
+		log.Printf("writing trace to %s for %s ...", *writeTrace, *traceDuration)
+		f, err := os.OpenFile(*writeTrace, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			panic(err)
+		}
+		if err := trace.Start(f); err != nil {
+			panic(err)
+		}
+		stopTrace = stopTraceOnce(f)
+		// -oom never returns and the runtime's own deadlock detector exits the
+		// process without running defers, so this timer is what actually stops
+		// the trace in those paths; the defer below only covers -panic and
+		// -exit.
+		time.AfterFunc(*traceDuration, stopTrace)
+		defer stopTrace()
+	}
+
 	// start the stacks
 	blockAllStacks := sync.Mutex{}
 	blockAllStacks.Lock()
@@ -50,6 +83,27 @@ func main() {
 	for i := 0; i < *runningGoroutines; i++ {
 		go running()
 	}
+	for i := 0; i < *syscallGoroutines; i++ {
+		// Alternate mechanisms so -syscallGoroutines broadens stack diversity
+		// beyond semacquire/runnable with both a "syscall" and an "IO wait"
+		// state, not just one of the two.
+		if i%2 == 0 {
+			go c1()
+		} else {
+			go d1()
+		}
+	}
+	for i := 0; i < *lockedOSThreads; i++ {
+		go e1(&blockAllStacks)
+	}
+	if *exitingThreads > 0 && *deadlock == "" {
+		// Like -pprofAddr and -writeTrace above, this must be skipped under
+		// -deadlock: a continuous stream of freshly spawned goroutines keeps
+		// at least one runnable at all times, so the runtime never sees every
+		// goroutine asleep and its deadlock detector never fires.
+		log.Printf("continuously spawning %d short-lived locked-OS-thread goroutines ...", *exitingThreads)
+		go runExitingThreads(*exitingThreads)
+	}
 
 	if *writeStacks != "" {
 		log.Printf("writing stacks to %s ...", *writeStacks)
@@ -67,6 +121,48 @@ func main() {
 		}
 	}
 
+	if *goTraceback != "" {
+		// Applies before -crashDump/-crashDumpSigquit below, controlling how
+		// much detail those runtime-driven dumps include.
+		debug.SetTraceback(*goTraceback)
+	}
+
+	if *crashDumpSigquit && *crashDump == "" {
+		log.Printf("warning: -crashDumpSigquit has no effect without -crashDump")
+	}
+
+	if *crashDump != "" {
+		log.Printf("writing crash dump to %s ...", *crashDump)
+		if err := os.WriteFile(*crashDump, fullGoroutineStack(), 0600); err != nil {
+			panic(err)
+		}
+
+		if *crashDumpSigquit {
+			// The default disposition for SIGQUIT is for the runtime to print its
+			// own all-goroutine traceback to stderr and exit; since it's not
+			// caught via signal.Notify here, raising it against our own pid lets
+			// that dump be compared against the runtime.Stack dump just written.
+			// SIGQUIT crashes the process without running defers or pending
+			// timers, so stop -writeTrace first or its file is left truncated.
+			stopTrace()
+			log.Printf("raising SIGQUIT against pid %d ...", os.Getpid())
+			raiseSigquit()
+			// Wait for the signal to be delivered and the runtime to exit the
+			// process, rather than racing ahead into -oom/-exit/-panic/-deadlock.
+			select {}
+		}
+	}
+
+	if *deadlock != "" {
+		// Every a1/b1 goroutine started above is already asleep on
+		// blockAllStacks; the pprof listener is already skipped above, so the
+		// only thing left to avoid is -oom's allocator loop, which we do by
+		// never reaching the block below. Block main the same way instead of
+		// falling through to -oom/-exit/-panic.
+		blockDeadlock(*deadlock)
+		return
+	}
+
 	if *oom {
 		log.Printf("allocating memory of size=%d MiB; touch=%t ...", *oomChunkSizeMiB, *oomTouch)
 		for {
@@ -87,6 +183,69 @@ func main() {
 	blockAllStacks.Lock()
 }
 
+// blockDeadlock blocks the calling goroutine (main) forever via the
+// mechanism named by mode, so that once every other goroutine is also
+// asleep, the runtime's own deadlock detector fires "fatal error: all
+// goroutines are asleep - deadlock!" instead of pprof.Lookup("goroutine")
+// being the only way to see the stacks. -deadlock implies disabling
+// -pprofAddr and -writeTrace and ignores -oom/-exit/-panic, since those
+// would otherwise keep the runtime from declaring a deadlock.
+//
+// Build with CGO_ENABLED=0: with cgo enabled, net's DNS resolver keeps a
+// thread permanently blocked in a system call, which the runtime treats as
+// a goroutine that might still wake up, so it never declares the deadlock.
+func blockDeadlock(mode string) {
+	log.Printf("blocking via -deadlock=%s ...", mode)
+	switch mode {
+	case "simple":
+		select {}
+	case "locked":
+		var mu sync.Mutex
+		mu.Lock()
+		mu.Lock()
+	case "chanrecv":
+		<-make(chan struct{})
+	default:
+		panic(fmt.Sprintf("unknown -deadlock mode %q; want simple, locked or chanrecv", mode))
+	}
+}
+
+// stopTraceOnce returns a function that stops the running runtime/trace
+// capture and closes f, doing so at most once so it is safe to call from
+// both the traceDuration timer and a defer in main. The trace started by
+// -writeTrace complements -writeStacks: it shows scheduler/GC/syscall
+// events over time, explaining why goroutines reached the states a stack
+// dump only snapshots.
+func stopTraceOnce(f *os.File) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			trace.Stop()
+			if err := f.Close(); err != nil {
+				log.Printf("error closing trace file %s: %v", f.Name(), err)
+			} else {
+				log.Printf("wrote trace to %s", f.Name())
+			}
+		})
+	}
+}
+
+// fullGoroutineStack returns the traceback of every goroutine, growing the
+// buffer passed to runtime.Stack until it's big enough to hold the whole
+// thing, the same technique the runtime itself uses before a fatal crash.
+// -crashDump writes this out so it can be diffed against the traceback the
+// runtime itself prints when GOTRACEBACK=all/crash and the program aborts.
+func fullGoroutineStack() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
 const oneMiB = 1024 * 1024
 
 func useMemory(chunkSizeMiB int, touch bool, mu *sync.Mutex) {
@@ -122,6 +281,80 @@ func b2(mu *sync.Mutex) {
 	mu.Unlock()
 }
 
+func c1() {
+	c2()
+}
+
+func c2() {
+	blockInRawSyscall()
+}
+
+func d1() {
+	d2()
+}
+
+func d2() {
+	blockInIOWait()
+}
+
+// blockInIOWait blocks reading from a pipe that's never written to. Pipes
+// created via os.Pipe are registered with the runtime's netpoller, so the
+// read parks the calling goroutine instead of blocking its OS thread,
+// producing a goroutine state of "IO wait". Unlike blockInRawSyscall, each
+// caller needs its own os.File: concurrent reads through the same *os.File
+// serialize on its internal fd lock, so sharing one here would leave most
+// callers stuck in "semacquire" instead of actually reaching "IO wait".
+func blockInIOWait() {
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	buf := make([]byte, 1)
+	_, _ = r.Read(buf)
+	// Keep the write end reachable: once collected, its finalizer closes it
+	// and the read above returns EOF instead of blocking.
+	runtime.KeepAlive(w)
+}
+
+func e1(mu *sync.Mutex) {
+	e2(mu)
+}
+
+// e2 locks its OS thread and never unlocks it, so the goroutine stays pinned
+// to that thread for as long as it blocks below, producing a "locked to
+// thread" stack for -lockedOSThreads to contrast against the regular A/B
+// stacks.
+func e2(mu *sync.Mutex) {
+	runtime.LockOSThread()
+	mu.Lock()
+	mu.Unlock()
+}
+
+// runExitingThreads continuously spawns short-lived goroutines that call
+// exitingThread, keeping at most concurrency of them in flight at once. A
+// naive unthrottled spawn loop outpaces how fast the runtime can actually
+// create and tear down the OS threads these goroutines lock, piling up
+// goroutines (and memory) without bound; the semaphore here caps that.
+func runExitingThreads(concurrency int) {
+	sem := make(chan struct{}, concurrency)
+	for {
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			exitingThread()
+		}()
+	}
+}
+
+// exitingThread locks its OS thread and returns without unlocking it. Since
+// the goroutine exits while still locked, the runtime terminates that OS
+// thread instead of returning it to the idle M pool, exercising the
+// M-freelist/thread-exit path and producing a runtime.goexit frame on a
+// locked M in profiles taken while this is running.
+func exitingThread() {
+	runtime.LockOSThread()
+}
+
 func burnCPU() int {
 	total := 0
 	for i := 0; i < 10000000; i++ {
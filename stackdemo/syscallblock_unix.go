@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+var (
+	rawSyscallReadOnce sync.Once
+	rawSyscallReadFD   int
+)
+
+// blockInRawSyscall blocks the calling goroutine in a genuine read(2) on a
+// pipe that's never written to, shared across every caller so
+// -syscallGoroutines doesn't grow the process's open file count. Unlike
+// os.Pipe, this raw fd is never registered with the runtime netpoller, so
+// the blocking call parks the whole OS thread rather than just the
+// goroutine, producing a goroutine state of "syscall" rather than "IO wait".
+func blockInRawSyscall() {
+	rawSyscallReadOnce.Do(func() {
+		var fds [2]int
+		if err := syscall.Pipe(fds[:]); err != nil {
+			panic(err)
+		}
+		rawSyscallReadFD = fds[0]
+	})
+	buf := make([]byte, 1)
+	_, _ = syscall.Read(rawSyscallReadFD, buf)
+}
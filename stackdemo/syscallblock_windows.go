@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+// blockInRawSyscall falls back to blockInIOWait: the raw, netpoller-bypassing
+// pipe read used on other platforms isn't implemented here for Windows, so
+// -syscallGoroutines only produces goroutines in state "IO wait" on this
+// platform.
+func blockInRawSyscall() {
+	blockInIOWait()
+}